@@ -6,6 +6,8 @@ import (
 
 	"github.com/crc-org/machine-driver-libvirt/pkg/libvirt"
 	"github.com/crc-org/machine/libmachine/drivers/plugin"
+	log "github.com/sirupsen/logrus"
+	golibvirt "libvirt.org/go/libvirt"
 )
 
 func main() {
@@ -15,5 +17,19 @@ func main() {
 			os.Exit(0)
 		}
 	}
+	// The event loop must be registered before any libvirt connection is
+	// opened for the driver to receive domain lifecycle events
+	if err := golibvirt.EventRegisterDefaultImpl(); err != nil {
+		log.Warnf("Failed to register libvirt event loop: %v", err)
+	} else {
+		go func() {
+			for {
+				if err := golibvirt.EventRunDefaultImpl(); err != nil {
+					log.Warnf("libvirt event loop failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
 	plugin.RegisterDriver(libvirt.NewDriver("default", "path"))
 }
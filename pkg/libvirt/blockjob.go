@@ -0,0 +1,147 @@
+package libvirt
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+// blockJobPollInterval is the delay between two checks of the progress of a
+// block job
+var blockJobPollInterval = time.Second
+
+// BlockJobInfo holds the progress of a block job running on a disk of the VM
+type BlockJobInfo struct {
+	// Type is pull, copy, commit, active-commit or backup
+	Type string
+	// Bandwidth is the speed limit of the job in bytes per second, 0 when
+	// the job is not limited
+	Bandwidth uint64
+	// Cur and End are the progress of the job, it is over when they are
+	// equal. Their unit is not specified.
+	Cur uint64
+	End uint64
+}
+
+func blockJobType(jobType libvirt.DomainBlockJobType) string {
+	switch jobType {
+	case libvirt.DOMAIN_BLOCK_JOB_TYPE_PULL:
+		return "pull"
+	case libvirt.DOMAIN_BLOCK_JOB_TYPE_COPY:
+		return "copy"
+	case libvirt.DOMAIN_BLOCK_JOB_TYPE_COMMIT:
+		return "commit"
+	case libvirt.DOMAIN_BLOCK_JOB_TYPE_ACTIVE_COMMIT:
+		return "active-commit"
+	case libvirt.DOMAIN_BLOCK_JOB_TYPE_BACKUP:
+		return "backup"
+	default:
+		return "unknown"
+	}
+}
+
+// GetBlockJobProgress returns the progress of the block job running on the
+// disk of the VM with the given target, such as vda. It returns nil when no
+// job is running on the disk.
+func (d *Driver) GetBlockJobProgress(disk string) (*BlockJobInfo, error) {
+	if err := d.validateVMRef(); err != nil {
+		return nil, err
+	}
+	info, err := d.vm.GetBlockJobInfo(disk, libvirt.DOMAIN_BLOCK_JOB_INFO_BANDWIDTH_BYTES)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get block job of disk %s: %w", disk, err)
+	}
+	// libvirt returns an empty job once the job is over
+	if info.Type == libvirt.DOMAIN_BLOCK_JOB_TYPE_UNKNOWN {
+		return nil, nil
+	}
+	return &BlockJobInfo{
+		Type:      blockJobType(info.Type),
+		Bandwidth: info.Bandwidth,
+		Cur:       info.Cur,
+		End:       info.End,
+	}, nil
+}
+
+// WaitForBlockJob waits until there is no block job running on the disk of
+// the VM with the given target or ctx is done
+func (d *Driver) WaitForBlockJob(ctx context.Context, disk string) error {
+	for {
+		info, err := d.GetBlockJobProgress(disk)
+		if err != nil {
+			return err
+		}
+		if info == nil {
+			return nil
+		}
+		log.Debugf("%s block job on disk %s: %d/%d", info.Type, disk, info.Cur, info.End)
+		if err := sleepContext(ctx, blockJobPollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// hasBackingStore returns true when the disk with the given target uses a
+// backing file in the XML of the domain
+func hasBackingStore(xmldoc string, target string) (bool, error) {
+	var domain libvirtxml.Domain
+	if err := domain.Unmarshal(xmldoc); err != nil {
+		return false, err
+	}
+	if domain.Devices == nil {
+		return false, nil
+	}
+	for _, disk := range domain.Devices.Disks {
+		if disk.Target == nil || disk.Target.Dev != target {
+			continue
+		}
+		// libvirt reports an empty backingStore element for the last
+		// image of the chain
+		backingStore := disk.BackingStore
+		if backingStore == nil || backingStore.Source == nil {
+			return false, nil
+		}
+		source := backingStore.Source
+		return source.File != nil || source.Block != nil || source.Network != nil, nil
+	}
+	return false, fmt.Errorf("Disk %s not found", target)
+}
+
+// FlattenDisk copies the data of the backing images of the disk of the VM
+// into the disk itself, so that it no longer depends on the bundle image.
+// The VM must be running as the copy is done by QEMU, FlattenDisk blocks
+// until it is over.
+func (d *Driver) FlattenDisk() error {
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	if err := d.checkRunning(); err != nil {
+		return err
+	}
+	target := d.getDiskTarget()
+	log.Debugf("Flattening disk %s of VM %s", target, d.MachineName)
+	if err := d.vm.BlockPull(target, 0, 0); err != nil {
+		return fmt.Errorf("Failed to start flattening disk %s: %w", target, err)
+	}
+	if err := d.WaitForBlockJob(context.Background(), target); err != nil {
+		return err
+	}
+
+	// The job also disappears when it fails, the disk must be checked
+	xmldoc, err := d.vm.GetXMLDesc(0)
+	if err != nil {
+		return err
+	}
+	backed, err := hasBackingStore(xmldoc, target)
+	if err != nil {
+		return err
+	}
+	if backed {
+		return fmt.Errorf("Disk %s of VM %s still uses a backing file after flattening", target, d.MachineName)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package libvirt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"libvirt.org/go/libvirt"
+)
+
+func TestHasBackingStore(t *testing.T) {
+	overlay := `<domain type="kvm">
+  <devices>
+    <disk type="file" device="disk">
+      <source file="/var/lib/crc/crc.qcow2"></source>
+      <backingStore type="file">
+        <format type="qcow2"></format>
+        <source file="/var/lib/crc/bundle.qcow2"></source>
+        <backingStore></backingStore>
+      </backingStore>
+      <target dev="vda" bus="virtio"></target>
+    </disk>
+  </devices>
+</domain>`
+	backed, err := hasBackingStore(overlay, "vda")
+	assert.NoError(t, err)
+	assert.True(t, backed)
+
+	_, err = hasBackingStore(overlay, "vdb")
+	assert.Error(t, err)
+
+	flat := `<domain type="kvm">
+  <devices>
+    <disk type="file" device="disk">
+      <source file="/var/lib/crc/crc.qcow2"></source>
+      <backingStore></backingStore>
+      <target dev="vda" bus="virtio"></target>
+    </disk>
+  </devices>
+</domain>`
+	backed, err = hasBackingStore(flat, "vda")
+	assert.NoError(t, err)
+	assert.False(t, backed)
+}
+
+func TestBlockJobType(t *testing.T) {
+	assert.Equal(t, "pull", blockJobType(libvirt.DOMAIN_BLOCK_JOB_TYPE_PULL))
+	assert.Equal(t, "active-commit", blockJobType(libvirt.DOMAIN_BLOCK_JOB_TYPE_ACTIVE_COMMIT))
+	assert.Equal(t, "unknown", blockJobType(libvirt.DOMAIN_BLOCK_JOB_TYPE_UNKNOWN))
+}
@@ -0,0 +1,63 @@
+package libvirt
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+// cdromTarget is the device name of the CD-ROM drive, it uses the SATA bus
+// as virtio does not support CD-ROMs
+const cdromTarget = "sdc"
+
+// cdromDevice returns the read-only CD-ROM drive of the VM, it has no media
+// when isoPath is empty
+func cdromDevice(isoPath string) libvirtxml.DomainDisk {
+	disk := libvirtxml.DomainDisk{
+		Device: "cdrom",
+		Driver: &libvirtxml.DomainDiskDriver{
+			Name: "qemu",
+			Type: "raw",
+		},
+		Target: &libvirtxml.DomainDiskTarget{
+			Dev: cdromTarget,
+			Bus: "sata",
+		},
+		ReadOnly: &libvirtxml.DomainDiskReadOnly{},
+	}
+	if isoPath != "" {
+		disk.Source = &libvirtxml.DomainDiskSource{
+			File: &libvirtxml.DomainDiskSourceFile{
+				File: isoPath,
+			},
+		}
+	}
+	return disk
+}
+
+// EjectCDROM removes the media from the CD-ROM drive of the running VM, the
+// drive stays empty the next time the VM starts
+func (d *Driver) EjectCDROM() error {
+	log.Debugf("Ejecting CD-ROM of VM %s", d.MachineName)
+	if d.ISOPath == "" {
+		return fmt.Errorf("VM %s has no CD-ROM attached", d.MachineName)
+	}
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	if err := d.checkRunning(); err != nil {
+		return err
+	}
+	disk := cdromDevice("")
+	xml, err := disk.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := d.vm.UpdateDeviceFlags(xml, libvirt.DOMAIN_DEVICE_MODIFY_LIVE|libvirt.DOMAIN_DEVICE_MODIFY_CONFIG); err != nil {
+		return fmt.Errorf("Failed to eject CD-ROM: %w", err)
+	}
+	d.ISOPath = ""
+	return nil
+}
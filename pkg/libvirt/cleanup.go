@@ -0,0 +1,284 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+// domainDiskPaths returns the image files of the disks of a domain, CD-ROMs
+// excluded
+func domainDiskPaths(xmldoc string) ([]string, error) {
+	var domain libvirtxml.Domain
+	if err := domain.Unmarshal(xmldoc); err != nil {
+		return nil, err
+	}
+	var paths []string
+	if domain.Devices == nil {
+		return paths, nil
+	}
+	for _, disk := range domain.Devices.Disks {
+		if disk.Device != "disk" || disk.Source == nil || disk.Source.File == nil {
+			continue
+		}
+		paths = append(paths, disk.Source.File.File)
+	}
+	return paths, nil
+}
+
+// isInDir returns true when path is inside dir
+func isInDir(path, dir string) bool {
+	return strings.HasPrefix(filepath.Clean(path), filepath.Clean(dir)+string(filepath.Separator))
+}
+
+// isDanglingVolume returns true when the volume at path is a disk image which
+// is used by no domain, usedPaths holds the disk images of all the domains
+// and their backing files
+func isDanglingVolume(path string, usedPaths map[string]bool) bool {
+	if filepath.Ext(path) != "."+ImageFormatQcow2 {
+		return false
+	}
+	return !usedPaths[filepath.Clean(path)]
+}
+
+// volumeBackingPath returns the backing file in the XML of a storage volume,
+// or an empty string when it has none
+func volumeBackingPath(xmldoc string) (string, error) {
+	var vol libvirtxml.StorageVolume
+	if err := vol.Unmarshal(xmldoc); err != nil {
+		return "", err
+	}
+	if vol.BackingStore == nil {
+		return "", nil
+	}
+	return vol.BackingStore.Path, nil
+}
+
+// addBackingChain adds path and the backing files of its volume to paths.
+// External snapshot overlays are backed by the previous disk images of the
+// VM, which only appear in the backing chain.
+func addBackingChain(conn *libvirt.Connect, path string, paths map[string]bool) error {
+	for path != "" && !paths[filepath.Clean(path)] {
+		paths[filepath.Clean(path)] = true
+		vol, err := conn.LookupStorageVolByPath(path)
+		if err != nil {
+			// Images outside of the storage pools, such as a bundle
+			// image, are never removed
+			var virErr libvirt.Error
+			if errors.As(err, &virErr) && virErr.Code == libvirt.ERR_NO_STORAGE_VOL {
+				return nil
+			}
+			return err
+		}
+		xmldoc, err := vol.GetXMLDesc(0)
+		_ = vol.Free()
+		if err != nil {
+			return err
+		}
+		if path, err = volumeBackingPath(xmldoc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usedDiskPaths returns the disk images of all the domains, their backing
+// files included
+func usedDiskPaths(conn *libvirt.Connect) (map[string]bool, error) {
+	doms, err := conn.ListAllDomains(0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list domains: %w", err)
+	}
+	defer func() {
+		for i := range doms {
+			_ = doms[i].Free()
+		}
+	}()
+	paths := map[string]bool{}
+	for i := range doms {
+		xmldoc, err := doms[i].GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+		if err != nil {
+			return nil, err
+		}
+		diskPaths, err := domainDiskPaths(xmldoc)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range diskPaths {
+			if err := addBackingChain(conn, path, paths); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return paths, nil
+}
+
+// isCleanedPool returns true when the disk images of the storage pool are
+// checked by CleanupOrphans: the pools inside storePath and the RAM disk pools
+func isCleanedPool(pool *libvirtxml.StoragePool, storePath string) bool {
+	if pool.Target == nil {
+		return false
+	}
+	if isInDir(pool.Target.Path, storePath) {
+		return true
+	}
+	return strings.HasPrefix(pool.Name, ramDiskPoolPrefix) && isInDir(pool.Target.Path, ramDiskDir)
+}
+
+// danglingVolumeGracePeriod is how long a disk image without domain is kept,
+// a VM being created has its disk image before its domain is defined
+const danglingVolumeGracePeriod = time.Hour
+
+// isRecentFile returns true when the file at path was modified less than
+// danglingVolumeGracePeriod ago
+func isRecentFile(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return timeNow().Sub(info.ModTime()) < danglingVolumeGracePeriod, nil
+}
+
+// isOrphanDomain returns true when the disk images or the store directory of
+// the stopped domain are missing, a running domain is never an orphan
+func isOrphanDomain(dom *libvirt.Domain, storePath string) (bool, error) {
+	active, err := dom.IsActive()
+	if err != nil || active {
+		return false, err
+	}
+	name, err := dom.GetName()
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(filepath.Join(storePath, "machines", name)); errors.Is(err, os.ErrNotExist) {
+		log.Debugf("Store directory of domain %s is missing", name)
+		return true, nil
+	}
+	xmldoc, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return false, err
+	}
+	paths, err := domainDiskPaths(xmldoc)
+	if err != nil {
+		return false, err
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			log.Debugf("Disk image %s of domain %s is missing", path, name)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CleanupOrphans removes what failed VM creations or manual cleanups left
+// behind: stopped domains created by this driver whose disk images or store
+// directory are missing, and the disk images used by no domain in the
+// storage pools inside storePath and in the crc-ram-* RAM disk pools. RAM disk
+// pools with a custom StoragePool name are not checked. It returns the list of
+// the removed domains and volumes.
+//
+// The disk image of a VM is created before its domain is defined, so that it
+// cannot be told apart from a leftover while the VM is being created. Disk
+// images modified during the last hour are kept for this reason, a creation
+// running concurrently with CleanupOrphans could otherwise lose its disk.
+func CleanupOrphans(conn *libvirt.Connect, storePath string) ([]string, error) {
+	var cleaned []string
+	crcDoms, err := listCRCDomains(conn)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, dom := range crcDoms {
+			_ = dom.Free()
+		}
+	}()
+	for _, dom := range crcDoms {
+		orphan, err := isOrphanDomain(dom, storePath)
+		if err != nil {
+			return cleaned, err
+		}
+		if !orphan {
+			continue
+		}
+		name, err := dom.GetName()
+		if err != nil {
+			return cleaned, err
+		}
+		log.Infof("Removing orphaned domain %s", name)
+		if err := dom.UndefineFlags(libvirt.DOMAIN_UNDEFINE_NVRAM | libvirt.DOMAIN_UNDEFINE_SNAPSHOTS_METADATA); err != nil {
+			return cleaned, fmt.Errorf("Failed to remove domain %s: %w", name, err)
+		}
+		cleaned = append(cleaned, fmt.Sprintf("domain %s", name))
+	}
+
+	volumes, err := removeDanglingVolumes(conn, storePath)
+	return append(cleaned, volumes...), err
+}
+
+// removeDanglingVolumes removes the disk images which are used by no domain
+// and were not modified recently, from the storage pools inside storePath
+// and the RAM disk pools
+func removeDanglingVolumes(conn *libvirt.Connect, storePath string) ([]string, error) {
+	usedPaths, err := usedDiskPaths(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	pools, err := conn.ListAllStoragePools(0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list storage pools: %w", err)
+	}
+	defer func() {
+		for i := range pools {
+			_ = pools[i].Free()
+		}
+	}()
+	var cleaned []string
+	for i := range pools {
+		xmldoc, err := pools[i].GetXMLDesc(0)
+		if err != nil {
+			return cleaned, err
+		}
+		var pool libvirtxml.StoragePool
+		if err := pool.Unmarshal(xmldoc); err != nil {
+			return cleaned, err
+		}
+		if !isCleanedPool(&pool, storePath) {
+			continue
+		}
+		vols, err := pools[i].ListAllStorageVolumes(0)
+		if err != nil {
+			return cleaned, err
+		}
+		for j := range vols {
+			vol := &vols[j]
+			path, err := vol.GetPath()
+			if err == nil && isDanglingVolume(path, usedPaths) {
+				var recent bool
+				recent, err = isRecentFile(path)
+				if err == nil && recent {
+					log.Debugf("Keeping recent disk image %s, its VM may still be being created", path)
+				} else if err == nil {
+					log.Infof("Removing dangling disk image %s", path)
+					err = vol.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
+					if err == nil {
+						cleaned = append(cleaned, fmt.Sprintf("volume %s", path))
+					}
+				}
+			}
+			_ = vol.Free()
+			if err != nil {
+				return cleaned, err
+			}
+		}
+	}
+	return cleaned, nil
+}
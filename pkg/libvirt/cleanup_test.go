@@ -0,0 +1,101 @@
+package libvirt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"libvirt.org/go/libvirtxml"
+)
+
+func TestDomainDiskPaths(t *testing.T) {
+	xmldoc := `<domain type="kvm">
+  <devices>
+    <disk type="file" device="disk">
+      <source file="/store/machines/crc/crc.qcow2"></source>
+      <target dev="vda" bus="virtio"></target>
+    </disk>
+    <disk type="file" device="disk">
+      <source file="/store/machines/crc/crc-extra.qcow2"></source>
+      <target dev="vdb" bus="virtio"></target>
+    </disk>
+    <disk type="file" device="cdrom">
+      <source file="/tmp/install.iso"></source>
+      <target dev="sdc" bus="sata"></target>
+    </disk>
+  </devices>
+</domain>`
+	paths, err := domainDiskPaths(xmldoc)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/store/machines/crc/crc.qcow2", "/store/machines/crc/crc-extra.qcow2"}, paths)
+}
+
+func TestIsInDir(t *testing.T) {
+	assert.True(t, isInDir("/store/machines/crc", "/store"))
+	assert.True(t, isInDir("/store/machines/crc/", "/store/"))
+	assert.False(t, isInDir("/store", "/store"))
+	assert.False(t, isInDir("/store2/machines", "/store"))
+}
+
+func TestIsDanglingVolume(t *testing.T) {
+	usedPaths := map[string]bool{
+		"/store/machines/crc/crc.qcow2":     true,
+		"/store/machines/crc-2/crc-2.qcow2": true,
+	}
+	assert.False(t, isDanglingVolume("/store/machines/crc/crc.qcow2", usedPaths))
+	assert.False(t, isDanglingVolume("/store/machines/crc//crc.qcow2", usedPaths))
+	assert.False(t, isDanglingVolume("/store/machines/crc/config.json", usedPaths))
+	assert.True(t, isDanglingVolume("/store/machines/crc/crc-extra.qcow2", usedPaths))
+	assert.True(t, isDanglingVolume("/store/machines/crc/old.qcow2", usedPaths))
+}
+
+func TestVolumeBackingPath(t *testing.T) {
+	path, err := volumeBackingPath(`<volume type="file">
+  <name>crc-snap1.qcow2</name>
+  <target>
+    <path>/store/machines/crc/crc-snap1.qcow2</path>
+  </target>
+  <backingStore>
+    <path>/store/machines/crc/crc.qcow2</path>
+    <format type="qcow2"></format>
+  </backingStore>
+</volume>`)
+	assert.NoError(t, err)
+	assert.Equal(t, "/store/machines/crc/crc.qcow2", path)
+
+	path, err = volumeBackingPath(`<volume type="file">
+  <name>crc.qcow2</name>
+</volume>`)
+	assert.NoError(t, err)
+	assert.Empty(t, path)
+}
+
+func TestIsCleanedPool(t *testing.T) {
+	pool := func(name, path string) *libvirtxml.StoragePool {
+		return &libvirtxml.StoragePool{Name: name, Target: &libvirtxml.StoragePoolTarget{Path: path}}
+	}
+	assert.True(t, isCleanedPool(pool("crc", "/store/machines/crc"), "/store"))
+	assert.True(t, isCleanedPool(pool("crc-ram-crc", "/dev/shm/crc-crc"), "/store"))
+	assert.False(t, isCleanedPool(pool("other", "/dev/shm/other"), "/store"))
+	assert.False(t, isCleanedPool(pool("default", "/var/lib/libvirt/images"), "/store"))
+	assert.False(t, isCleanedPool(&libvirtxml.StoragePool{Name: "crc"}, "/store"))
+}
+
+func TestIsRecentFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.qcow2")
+	assert.NoError(t, os.WriteFile(path, nil, 0600))
+	recent, err := isRecentFile(path)
+	assert.NoError(t, err)
+	assert.True(t, recent)
+
+	modTime := time.Now().Add(-2 * danglingVolumeGracePeriod)
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+	recent, err = isRecentFile(path)
+	assert.NoError(t, err)
+	assert.False(t, recent)
+
+	_, err = isRecentFile(filepath.Join(t.TempDir(), "missing.qcow2"))
+	assert.Error(t, err)
+}
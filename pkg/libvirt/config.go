@@ -0,0 +1,545 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (d *Driver) getFirmware() string {
+	if d.Firmware != "" {
+		return d.Firmware
+	}
+	return DefaultFirmware
+}
+
+func (d *Driver) getGraphics() string {
+	if d.Graphics != "" {
+		return d.Graphics
+	}
+	return DefaultGraphics
+}
+
+func (d *Driver) getCPUMode() string {
+	if d.CPUMode != "" {
+		return d.CPUMode
+	}
+	return DefaultCPUMode
+}
+
+func (d *Driver) getNetworkMode() string {
+	if d.NetworkMode != "" {
+		return d.NetworkMode
+	}
+	return DefaultNetworkMode
+}
+
+// getMaxCPU returns the maximum vCPU count of a VM with the given vCPU count
+func (d *Driver) getMaxCPU(cpus int) int {
+	// libvirt requires the NUMA nodes to hold all the possible vCPUs
+	if len(d.NUMANodes) > 0 {
+		return cpus
+	}
+	if d.MaxCPU < cpus {
+		return cpus
+	}
+	return d.MaxCPU
+}
+
+// getMaxMemory returns the maximum memory size in MiB of a VM with the given
+// memory size
+func (d *Driver) getMaxMemory(memory int) int {
+	// libvirt requires the NUMA nodes to hold all the possible memory
+	if len(d.NUMANodes) > 0 || d.MaxMemory < memory {
+		return memory
+	}
+	return d.MaxMemory
+}
+
+// hasMemBalloon returns true when the VM needs a balloon device, to change
+// its memory size while it runs or to get memory statistics
+func (d *Driver) hasMemBalloon() bool {
+	return d.MaxMemory > 0 || d.MemoryStatsPeriod > 0
+}
+
+func (d *Driver) getNICModel() string {
+	if d.NICModel != "" {
+		return d.NICModel
+	}
+	return DefaultNICModel
+}
+
+// hasNetwork returns true when the VM has a network interface, in direct and
+// user modes Network is not used
+func (d *Driver) hasNetwork() bool {
+	return d.Network != "" || d.getNetworkMode() == NetworkModeDirect || d.getNetworkMode() == NetworkModeUser
+}
+
+func (d *Driver) getClockOffset() string {
+	if d.ClockOffset != "" {
+		return d.ClockOffset
+	}
+	return DefaultClockOffset
+}
+
+func (d *Driver) getRNG() string {
+	if d.RNG != "" {
+		return d.RNG
+	}
+	return DefaultRNG
+}
+
+// getVideoModel returns the video model of the VM, an empty string lets
+// libvirt pick the model matching the graphics type
+func (d *Driver) getVideoModel() string {
+	if d.VideoModel == "" && d.getGraphics() == GraphicsNone {
+		return VideoModelNone
+	}
+	return d.VideoModel
+}
+
+func (d *Driver) getSMBIOSManufacturer() string {
+	if d.SMBIOSManufacturer != "" {
+		return d.SMBIOSManufacturer
+	}
+	return DefaultSMBIOSManufacturer
+}
+
+func (d *Driver) getSMBIOSProduct() string {
+	if d.SMBIOSProduct != "" {
+		return d.SMBIOSProduct
+	}
+	return DefaultSMBIOSProduct
+}
+
+func (d *Driver) getStartTimeout() time.Duration {
+	if d.StartTimeout > 0 {
+		return time.Duration(d.StartTimeout) * time.Second
+	}
+	return defaultStartTimeout
+}
+
+// getConnectRetries returns how many times opening the libvirt connection is
+// retried after a failure
+func (d *Driver) getConnectRetries() int {
+	switch {
+	case d.ConnectRetries < 0:
+		return 0
+	case d.ConnectRetries == 0:
+		return defaultConnectRetries
+	default:
+		return d.ConnectRetries
+	}
+}
+
+func (d *Driver) getSSHTimeout() time.Duration {
+	if d.SSHTimeout > 0 {
+		return time.Duration(d.SSHTimeout) * time.Second
+	}
+	return defaultSSHTimeout
+}
+
+func (d *Driver) getGuestAgentTimeout() time.Duration {
+	if d.GuestAgentTimeout > 0 {
+		return time.Duration(d.GuestAgentTimeout) * time.Second
+	}
+	return defaultAgentTimeout
+}
+
+// ResolveStorePath returns the path of file in the machine directory of the
+// VM
+func (d *Driver) ResolveStorePath(file string) string {
+	if d.MachineDir != "" {
+		return filepath.Join(d.MachineDir, file)
+	}
+	return d.Driver.ResolveStorePath(file)
+}
+
+// getStoragePoolPath returns the directory where the VM disk images are
+// stored, it is the target path of the storage pool
+func (d *Driver) getStoragePoolPath() string {
+	if d.StoragePoolPath != "" {
+		return d.StoragePoolPath
+	}
+	if d.RAMDisk {
+		return filepath.Join(ramDiskDir, fmt.Sprintf("crc-%s", d.MachineName))
+	}
+	return d.ResolveStorePath(".")
+}
+
+func (d *Driver) getDiskBus() string {
+	if d.DiskBus != "" {
+		return d.DiskBus
+	}
+	return DefaultDiskBus
+}
+
+// getDiskTarget returns the device name of the VM disk, which depends on its
+// bus type
+func (d *Driver) getDiskTarget() string {
+	if d.getDiskBus() == DiskBusVirtio {
+		return "vda"
+	}
+	return "sda"
+}
+
+func (d *Driver) getExtraDiskTarget() string {
+	if d.getDiskBus() == DiskBusVirtio {
+		return "vdb"
+	}
+	return "sdb"
+}
+
+// getDiskDiscard returns the discard attribute of the disk driver, the
+// attribute is omitted when discard requests are ignored as this is the
+// libvirt default
+func (d *Driver) getDiskDiscard() string {
+	if d.DiskDiscard == DiskDiscardUnmap {
+		return DiskDiscardUnmap
+	}
+	return ""
+}
+
+var (
+	validCacheModes = []string{"default", "none", "writethrough", "writeback", "directsync", "unsafe"}
+	validIOModes    = []string{"threads", "native"}
+)
+
+// supportedImageFormats are the formats of VM images the driver can use
+var supportedImageFormats = []string{ImageFormatQcow2}
+
+func (d *Driver) validateImageFormat() error {
+	return validateChoice("image format", d.ImageFormat, supportedImageFormats)
+}
+
+func validateChoice(kind, value string, validValues []string) error {
+	for _, valid := range validValues {
+		if value == valid {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid %s '%s', valid values are: %s", kind, value, strings.Join(validValues, ", "))
+}
+
+func validateCacheMode(mode string) error {
+	if mode == "" {
+		return nil
+	}
+	return validateChoice("disk cache mode", mode, validCacheModes)
+}
+
+func validateIOMode(mode string) error {
+	if mode == "" {
+		return nil
+	}
+	return validateChoice("disk IO mode", mode, validIOModes)
+}
+
+// parseClusterSize returns the size in bytes of a qcow2 cluster size such as
+// 64k or 2M, which must be a power of two between 512 bytes and 2 MiB
+func parseClusterSize(size string) (uint64, error) {
+	multiplier := uint64(1)
+	digits := size
+	switch {
+	case strings.HasSuffix(size, "k"), strings.HasSuffix(size, "K"):
+		multiplier = 1024
+		digits = size[:len(size)-1]
+	case strings.HasSuffix(size, "M"):
+		multiplier = 1024 * 1024
+		digits = size[:len(size)-1]
+	}
+	value, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid qcow2 cluster size '%s'", size)
+	}
+	bytes := value * multiplier
+	if bytes < 512 || bytes > 2*1024*1024 || bytes&(bytes-1) != 0 {
+		return 0, fmt.Errorf("Invalid qcow2 cluster size '%s', it must be a power of two between 512 and 2M", size)
+	}
+	return bytes, nil
+}
+
+func (d *Driver) validateQcow2Options() error {
+	if d.Qcow2Preallocation != "" {
+		if err := validateChoice("qcow2 preallocation mode", d.Qcow2Preallocation, []string{PreallocationOff, PreallocationMetadata, PreallocationFalloc, PreallocationFull}); err != nil {
+			return err
+		}
+	}
+	if d.Qcow2ClusterSize != "" {
+		size, err := parseClusterSize(d.Qcow2ClusterSize)
+		if err != nil {
+			return err
+		}
+		// Subclusters, needed for preallocation, require 16k clusters
+		if size < 16*1024 && d.Qcow2Preallocation != "" && d.Qcow2Preallocation != PreallocationOff {
+			return errors.New("qcow2 preallocation requires a cluster size of at least 16k")
+		}
+	}
+	return nil
+}
+
+// qcow2Options returns the qemu-img creation options of the VM disk image
+func (d *Driver) qcow2Options() []string {
+	var options []string
+	if d.Qcow2ClusterSize != "" {
+		options = append(options, fmt.Sprintf("cluster_size=%s", d.Qcow2ClusterSize))
+	}
+	if d.Qcow2Preallocation != "" {
+		options = append(options, fmt.Sprintf("preallocation=%s", d.Qcow2Preallocation))
+		// qemu refuses to preallocate an image with a backing file unless
+		// it uses subclusters
+		if d.Qcow2Preallocation != PreallocationOff {
+			options = append(options, "extended_l2=on")
+		}
+	}
+	return options
+}
+
+// getDiskCacheMode returns the cache attribute of the disk driver, the
+// attribute is omitted when using the hypervisor default
+func (d *Driver) getDiskCacheMode() string {
+	if d.CacheMode == "default" {
+		return ""
+	}
+	return d.CacheMode
+}
+
+// getDiskIOMode returns the io attribute of the disk driver, the attribute
+// is omitted when using the hypervisor default
+func (d *Driver) getDiskIOMode() string {
+	if d.IOMode == "threads" {
+		return ""
+	}
+	return d.IOMode
+}
+
+// validateConfig checks the driver configuration values which can be
+// verified without a libvirt connection
+func (d *Driver) validateConfig() error {
+	if err := validateChoice("graphics type", d.getGraphics(), []string{GraphicsNone, GraphicsVNC, GraphicsSpice}); err != nil {
+		return err
+	}
+
+	if err := validateChoice("CPU mode", d.getCPUMode(), []string{CPUModeHostPassthrough, CPUModeHostModel, CPUModeCustom}); err != nil {
+		return err
+	}
+	if d.getCPUMode() == CPUModeCustom && d.CPUModel == "" {
+		return errors.New("A CPU model is required with the custom CPU mode")
+	}
+
+	if err := validateChoice("network mode", d.getNetworkMode(), []string{NetworkModeNetwork, NetworkModeBridge, NetworkModeDirect, NetworkModeUser}); err != nil {
+		return err
+	}
+	if d.getNetworkMode() == NetworkModeDirect && d.HostInterface == "" {
+		return errors.New("A host interface is required in direct network mode")
+	}
+	if err := d.validatePortForwards(); err != nil {
+		return err
+	}
+	if err := validateChoice("NIC model", d.getNICModel(), []string{NICModelVirtio, NICModelE1000, NICModelE1000e, NICModelRTL8139}); err != nil {
+		return err
+	}
+
+	if err := validateChoice("clock offset", d.getClockOffset(), []string{ClockOffsetUTC, ClockOffsetLocaltime}); err != nil {
+		return err
+	}
+
+	if err := validateChoice("RNG source", d.getRNG(), []string{RNGNone, RNGURandom, RNGRandom}); err != nil {
+		return err
+	}
+
+	if d.Watchdog != "" {
+		if err := validateChoice("watchdog action", d.Watchdog, []string{WatchdogNone, WatchdogReset, WatchdogPoweroff, WatchdogPause}); err != nil {
+			return err
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, dev := range d.BootOrder {
+		if err := validateChoice("boot device", dev, []string{BootDeviceHD, BootDeviceCDROM, BootDeviceNetwork}); err != nil {
+			return err
+		}
+		if seen[dev] {
+			return fmt.Errorf("Duplicate boot device %s", dev)
+		}
+		seen[dev] = true
+	}
+
+	if d.PanicDevice != "" {
+		if err := validateChoice("panic device", d.PanicDevice, []string{PanicModelISA, PanicModelPVPanic, PanicModelHyperV}); err != nil {
+			return err
+		}
+	}
+
+	lifecycleActions := []string{LifecycleDestroy, LifecycleRestart, LifecyclePreserve}
+	if d.OnCrash != "" {
+		if err := validateChoice("crash action", d.OnCrash, append(lifecycleActions, LifecycleCoredumpDestroy, LifecycleCoredumpRestart)); err != nil {
+			return err
+		}
+	}
+	if d.OnPoweroff != "" {
+		if err := validateChoice("poweroff action", d.OnPoweroff, lifecycleActions); err != nil {
+			return err
+		}
+	}
+	if d.OnReboot != "" {
+		if err := validateChoice("reboot action", d.OnReboot, lifecycleActions); err != nil {
+			return err
+		}
+	}
+
+	if d.VideoModel != "" {
+		if err := validateChoice("video model", d.VideoModel, []string{VideoModelNone, VideoModelVirtio, VideoModelQXL, VideoModelVGA}); err != nil {
+			return err
+		}
+	}
+	if d.VideoVRAM != 0 && d.VideoModel != VideoModelQXL && d.VideoModel != VideoModelVGA {
+		return fmt.Errorf("Video memory can only be set for the %s and %s video models", VideoModelQXL, VideoModelVGA)
+	}
+
+	if err := d.validateNUMA(); err != nil {
+		return err
+	}
+	if err := validateMemoryTune(d.Memory, d.MemoryHardLimit, d.MemorySoftLimit, d.MemorySwapHardLimit); err != nil {
+		return err
+	}
+	if err := validateCPUTune(d.CPUShares, d.CPUQuota, d.CPUPeriod); err != nil {
+		return err
+	}
+	if err := d.validateSMBIOS(); err != nil {
+		return err
+	}
+
+	if d.IOThreads > uint(d.CPU) {
+		return fmt.Errorf("Invalid IO thread count %d, the VM only has %d vCPUs", d.IOThreads, d.CPU)
+	}
+	if d.IOThreads > 0 && d.getDiskBus() == DiskBusSATA {
+		return fmt.Errorf("IO threads cannot be used with the %s disk bus", DiskBusSATA)
+	}
+
+	// Renaming the VM sets the storage pool path to the RAM disk directory
+	if d.RAMDisk && d.StoragePoolPath != "" && !isInDir(d.StoragePoolPath, ramDiskDir) {
+		return fmt.Errorf("The RAM disk cannot be used with a storage pool path outside of %s", ramDiskDir)
+	}
+
+	if (d.ExtraDiskShareable || d.ExtraDiskReadOnly) && d.ExtraDiskSize == 0 {
+		return errors.New("The shareable and read-only options require an extra disk")
+	}
+
+	if err := validateChoice("disk bus", d.getDiskBus(), []string{DiskBusVirtio, DiskBusSATA, DiskBusSCSI}); err != nil {
+		return err
+	}
+
+	if err := validateCacheMode(d.CacheMode); err != nil {
+		return err
+	}
+	if err := d.validateQcow2Options(); err != nil {
+		return err
+	}
+	if err := validateIOMode(d.IOMode); err != nil {
+		return err
+	}
+
+	if d.DiskDiscard != "" {
+		if err := validateChoice("disk discard mode", d.DiskDiscard, []string{DiskDiscardIgnore, DiskDiscardUnmap}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) validateIgnitionPath() error {
+	if d.IgnitionPath == "" {
+		return nil
+	}
+	f, err := os.Open(d.IgnitionPath)
+	if err != nil {
+		return fmt.Errorf("Cannot read ignition config file: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("Cannot read ignition config file: %w", err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("Ignition config %s is a directory", d.IgnitionPath)
+	}
+	return nil
+}
+
+func (d *Driver) validateSharedDirs() error {
+	tags := map[string]bool{}
+	for _, sharedDir := range d.SharedDirs {
+		if sharedDir.Tag == "" {
+			return fmt.Errorf("Missing tag for shared directory %s", sharedDir.Source)
+		}
+		if tags[sharedDir.Tag] {
+			return fmt.Errorf("Duplicate tag '%s' for shared directory %s", sharedDir.Tag, sharedDir.Source)
+		}
+		tags[sharedDir.Tag] = true
+		info, err := os.Stat(sharedDir.Source)
+		if err != nil {
+			return fmt.Errorf("Cannot share directory with the VM: %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("Cannot share %s with the VM, it is not a directory", sharedDir.Source)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) validateISOPath() error {
+	if d.ISOPath == "" {
+		return nil
+	}
+	info, err := os.Stat(d.ISOPath)
+	if err != nil {
+		return fmt.Errorf("Cannot attach ISO image: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("Cannot attach ISO image: %s is not a regular file", d.ISOPath)
+	}
+	return nil
+}
+
+// validateKernel checks the files used for direct kernel boot exist
+func (d *Driver) validateKernel() error {
+	if d.Kernel == "" {
+		if d.Initrd != "" || d.Cmdline != "" {
+			return errors.New("An initrd or kernel command line requires a kernel")
+		}
+		return nil
+	}
+	for _, path := range []string{d.Kernel, d.Initrd} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("Invalid kernel boot file: %w", err)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("Invalid kernel boot file: %s is not a regular file", path)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) validateEmulatorPath() error {
+	if d.EmulatorPath == "" {
+		return nil
+	}
+	info, err := os.Stat(d.EmulatorPath)
+	if err != nil {
+		return fmt.Errorf("Invalid emulator: %w", err)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("Invalid emulator: %s is not an executable file", d.EmulatorPath)
+	}
+	return nil
+}
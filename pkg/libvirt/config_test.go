@@ -0,0 +1,344 @@
+package libvirt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/crc-org/machine/libmachine/drivers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateCacheMode(t *testing.T) {
+	for _, tt := range []struct {
+		mode  string
+		valid bool
+	}{
+		{"", true},
+		{"default", true},
+		{"none", true},
+		{"writethrough", true},
+		{"writeback", true},
+		{"directsync", true},
+		{"unsafe", true},
+		{"writetrough", false},
+		{"None", false},
+	} {
+		err := validateCacheMode(tt.mode)
+		if tt.valid {
+			assert.NoError(t, err, tt.mode)
+		} else {
+			assert.Error(t, err, tt.mode)
+		}
+	}
+}
+
+func TestValidateIOMode(t *testing.T) {
+	for _, tt := range []struct {
+		mode  string
+		valid bool
+	}{
+		{"", true},
+		{"threads", true},
+		{"native", true},
+		{"thread", false},
+		{"io_uring", false},
+	} {
+		err := validateIOMode(tt.mode)
+		if tt.valid {
+			assert.NoError(t, err, tt.mode)
+		} else {
+			assert.Error(t, err, tt.mode)
+		}
+	}
+}
+
+func TestValidateIgnitionPath(t *testing.T) {
+	dir := t.TempDir()
+	d := testDriver()
+	assert.NoError(t, d.validateIgnitionPath())
+
+	d.IgnitionPath = filepath.Join(dir, "missing.ign")
+	assert.Error(t, d.validateIgnitionPath())
+
+	d.IgnitionPath = dir
+	assert.Error(t, d.validateIgnitionPath())
+
+	d.IgnitionPath = filepath.Join(dir, "config.ign")
+	assert.NoError(t, os.WriteFile(d.IgnitionPath, []byte("{}"), 0600))
+	assert.NoError(t, d.validateIgnitionPath())
+}
+
+func TestValidateSharedDirs(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	assert.NoError(t, os.WriteFile(file, nil, 0600))
+
+	d := testDriver()
+	assert.NoError(t, d.validateSharedDirs())
+
+	d.SharedDirs = []drivers.SharedDir{{Source: dir, Tag: "dir0"}, {Source: dir, Tag: "dir1"}}
+	assert.NoError(t, d.validateSharedDirs())
+
+	d.SharedDirs = []drivers.SharedDir{{Source: dir, Tag: "dir0"}, {Source: dir, Tag: "dir0"}}
+	assert.Error(t, d.validateSharedDirs())
+
+	d.SharedDirs = []drivers.SharedDir{{Source: dir}}
+	assert.Error(t, d.validateSharedDirs())
+
+	d.SharedDirs = []drivers.SharedDir{{Source: filepath.Join(dir, "missing"), Tag: "dir0"}}
+	assert.Error(t, d.validateSharedDirs())
+
+	d.SharedDirs = []drivers.SharedDir{{Source: file, Tag: "dir0"}}
+	assert.Error(t, d.validateSharedDirs())
+}
+
+func TestValidateCPUMode(t *testing.T) {
+	d := testDriver()
+	assert.NoError(t, d.validateConfig())
+
+	d.CPUMode = CPUModeHostModel
+	assert.NoError(t, d.validateConfig())
+
+	d.CPUMode = "host"
+	assert.Error(t, d.validateConfig())
+
+	d.CPUMode = CPUModeCustom
+	assert.Error(t, d.validateConfig())
+
+	d.CPUModel = "Skylake-Client"
+	assert.NoError(t, d.validateConfig())
+}
+
+func TestValidateWatchdog(t *testing.T) {
+	d := testDriver()
+	for _, action := range []string{"", WatchdogNone, WatchdogReset, WatchdogPoweroff, WatchdogPause} {
+		d.Watchdog = action
+		assert.NoError(t, d.validateConfig(), action)
+	}
+	d.Watchdog = "reboot"
+	assert.Error(t, d.validateConfig())
+}
+
+func TestValidateEmulatorPath(t *testing.T) {
+	dir := t.TempDir()
+	d := testDriver()
+	assert.NoError(t, d.validateEmulatorPath())
+
+	d.EmulatorPath = filepath.Join(dir, "missing")
+	assert.Error(t, d.validateEmulatorPath())
+
+	d.EmulatorPath = dir
+	assert.Error(t, d.validateEmulatorPath())
+
+	d.EmulatorPath = filepath.Join(dir, "qemu-system-x86_64")
+	assert.NoError(t, os.WriteFile(d.EmulatorPath, nil, 0600))
+	assert.Error(t, d.validateEmulatorPath())
+
+	assert.NoError(t, os.Chmod(d.EmulatorPath, 0700))
+	assert.NoError(t, d.validateEmulatorPath())
+}
+
+func TestValidateNICModel(t *testing.T) {
+	d := testDriver()
+	for _, model := range []string{"", NICModelVirtio, NICModelE1000, NICModelE1000e, NICModelRTL8139} {
+		d.NICModel = model
+		assert.NoError(t, d.validateConfig(), model)
+	}
+	d.NICModel = "ne2k_pci"
+	assert.Error(t, d.validateConfig())
+}
+
+func TestValidateKernel(t *testing.T) {
+	d := testDriver()
+	assert.NoError(t, d.validateKernel())
+
+	d.Cmdline = "console=ttyS0"
+	assert.Error(t, d.validateKernel())
+
+	dir := t.TempDir()
+	d.Kernel = filepath.Join(dir, "vmlinuz")
+	assert.Error(t, d.validateKernel())
+	assert.NoError(t, os.WriteFile(d.Kernel, []byte("kernel"), 0600))
+	assert.NoError(t, d.validateKernel())
+
+	d.Initrd = dir
+	assert.Error(t, d.validateKernel())
+}
+
+func TestValidateBootOrder(t *testing.T) {
+	d := testDriver()
+	d.BootOrder = []string{BootDeviceHD, BootDeviceCDROM, BootDeviceNetwork}
+	assert.NoError(t, d.validateConfig())
+
+	d.BootOrder = []string{BootDeviceHD, "floppy"}
+	assert.Error(t, d.validateConfig())
+
+	d.BootOrder = []string{BootDeviceHD, BootDeviceHD}
+	assert.Error(t, d.validateConfig())
+}
+
+func TestValidateISOPath(t *testing.T) {
+	d := testDriver()
+	assert.NoError(t, d.validateISOPath())
+
+	d.ISOPath = filepath.Join(t.TempDir(), "install.iso")
+	assert.ErrorContains(t, d.validateISOPath(), "Cannot attach ISO image")
+	assert.NoError(t, os.WriteFile(d.ISOPath, []byte("iso"), 0600))
+	assert.NoError(t, d.validateISOPath())
+}
+
+func TestValidateLifecycleActions(t *testing.T) {
+	d := testDriver()
+	d.OnCrash = LifecycleCoredumpRestart
+	d.OnPoweroff = LifecyclePreserve
+	d.OnReboot = LifecycleRestart
+	assert.NoError(t, d.validateConfig())
+
+	d.OnReboot = LifecycleCoredumpRestart
+	assert.Error(t, d.validateConfig())
+
+	d.OnReboot = ""
+	d.OnCrash = "reboot"
+	assert.Error(t, d.validateConfig())
+}
+
+func TestValidateVideo(t *testing.T) {
+	d := testDriver()
+	for _, model := range []string{"", VideoModelNone, VideoModelVirtio, VideoModelQXL, VideoModelVGA} {
+		d.VideoModel = model
+		assert.NoError(t, d.validateConfig(), model)
+	}
+	d.VideoModel = "cirrus"
+	assert.Error(t, d.validateConfig())
+
+	d.VideoModel = VideoModelVirtio
+	d.VideoVRAM = 16384
+	assert.Error(t, d.validateConfig())
+	d.VideoModel = VideoModelVGA
+	assert.NoError(t, d.validateConfig())
+}
+
+func TestValidatePanicDevice(t *testing.T) {
+	d := testDriver()
+	for _, model := range []string{"", PanicModelISA, PanicModelPVPanic, PanicModelHyperV} {
+		d.PanicDevice = model
+		assert.NoError(t, d.validateConfig(), model)
+	}
+	d.PanicDevice = "s390"
+	assert.Error(t, d.validateConfig())
+}
+
+func TestValidateExtraDiskOptions(t *testing.T) {
+	d := testDriver()
+	d.ExtraDiskShareable = true
+	assert.Error(t, d.validateConfig())
+
+	d.ExtraDiskSize = 10
+	assert.NoError(t, d.validateConfig())
+}
+
+func TestValidateImageFormat(t *testing.T) {
+	d := testDriver()
+	d.ImageFormat = ImageFormatQcow2
+	assert.NoError(t, d.validateImageFormat())
+
+	d.ImageFormat = "raw"
+	assert.Error(t, d.validateImageFormat())
+}
+
+func TestValidateIOThreads(t *testing.T) {
+	d := testDriver()
+	d.IOThreads = 4
+	assert.NoError(t, d.validateConfig())
+
+	d.IOThreads = 5
+	assert.Error(t, d.validateConfig())
+
+	d.IOThreads = 1
+	d.DiskBus = DiskBusSATA
+	assert.Error(t, d.validateConfig())
+}
+
+func TestValidateSMBIOS(t *testing.T) {
+	d := testDriver()
+	d.SMBIOSUUID = "c7a5fdbd-edaf-9455-926a-d65c16db1809"
+	assert.NoError(t, d.validateConfig())
+
+	d.SMBIOSUUID = "c7a5fdbd-edaf-9455-926a"
+	assert.Error(t, d.validateConfig())
+
+	d.SMBIOSUUID = "c7a5fdbd-edaf-9455-926a-d65c16db1809"
+	d.UUID = "2b0e6c4c-1f4c-4e4f-8e0a-0c3b1d1e2f3a"
+	assert.Error(t, d.validateConfig())
+}
+
+func TestValidateQcow2Options(t *testing.T) {
+	d := testDriver()
+	assert.NoError(t, d.validateConfig())
+	assert.Empty(t, d.qcow2Options())
+
+	d.Qcow2ClusterSize = "2M"
+	d.Qcow2Preallocation = PreallocationMetadata
+	assert.NoError(t, d.validateConfig())
+	assert.Equal(t, []string{"cluster_size=2M", "preallocation=metadata", "extended_l2=on"}, d.qcow2Options())
+
+	d.Qcow2Preallocation = PreallocationOff
+	assert.Equal(t, []string{"cluster_size=2M", "preallocation=off"}, d.qcow2Options())
+
+	d.Qcow2Preallocation = "sparse"
+	assert.Error(t, d.validateConfig())
+
+	d.Qcow2Preallocation = ""
+	for _, size := range []string{"4M", "256", "48k", "64kB", "k"} {
+		d.Qcow2ClusterSize = size
+		assert.Error(t, d.validateConfig(), size)
+	}
+	for _, size := range []string{"512", "64k", "64K", "1M"} {
+		d.Qcow2ClusterSize = size
+		assert.NoError(t, d.validateConfig(), size)
+	}
+
+	d.Qcow2ClusterSize = "8k"
+	d.Qcow2Preallocation = PreallocationFull
+	assert.Error(t, d.validateConfig())
+}
+
+func TestRAMDisk(t *testing.T) {
+	d := testDriver()
+	d.RAMDisk = true
+	assert.NoError(t, d.validateConfig())
+	assert.Equal(t, "/dev/shm/crc-domain/domain.test", d.getDiskImagePath())
+	assert.Equal(t, "crc-ram-domain", d.getStoragePoolName())
+
+	// The pool of the VM disks in the store directory cannot be reused
+	storePoolXML := `<pool type="dir">
+  <name>domain</name>
+  <target>
+    <path>/home/user/.crc/machines/domain</path>
+  </target>
+</pool>`
+	assert.Error(t, checkPoolTarget(storePoolXML, d.getStoragePoolPath()))
+	ramPoolXML := `<pool type="dir">
+  <name>crc-ram-domain</name>
+  <target>
+    <path>/dev/shm/crc-domain</path>
+  </target>
+</pool>`
+	assert.NoError(t, checkPoolTarget(ramPoolXML, d.getStoragePoolPath()))
+
+	d.StoragePoolPath = "/var/lib/crc"
+	assert.Error(t, d.validateConfig())
+}
+
+func TestGetMaxCPU(t *testing.T) {
+	d := testDriver()
+	assert.Equal(t, 4, d.getMaxCPU(4))
+
+	d.MaxCPU = 8
+	assert.Equal(t, 8, d.getMaxCPU(4))
+	assert.Equal(t, 10, d.getMaxCPU(10))
+
+	d.NUMANodes = []NUMANode{{CPUs: "0-3", Memory: 4096}}
+	assert.Equal(t, 4, d.getMaxCPU(4))
+}
@@ -0,0 +1,80 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/crc-org/machine/libmachine/drivers"
+	log "github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirt"
+)
+
+// GetConsoleLogPath returns the path of the file where the output of the VM
+// serial console is logged
+func (d *Driver) GetConsoleLogPath() string {
+	return d.ResolveStorePath(fmt.Sprintf("%s-console.log", d.MachineName))
+}
+
+// ReadConsoleLog returns the serial console output of the last VM boot
+func (d *Driver) ReadConsoleLog() ([]byte, error) {
+	return os.ReadFile(d.GetConsoleLogPath())
+}
+
+type consoleStream struct {
+	stream *libvirt.Stream
+}
+
+func (c *consoleStream) Read(p []byte) (int, error) {
+	n, err := c.stream.Recv(p)
+	if err != nil {
+		return n, err
+	}
+	if n == 0 && len(p) != 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (c *consoleStream) Close() error {
+	err := c.stream.Abort()
+	_ = c.stream.Free()
+	return err
+}
+
+// GetConsoleOutput connects to the serial console of the running VM and
+// returns a reader for its live output. Only one client can be connected to
+// the console at a time, the returned reader must be closed to release it.
+func (d *Driver) GetConsoleOutput() (io.ReadCloser, error) {
+	log.Debugf("Opening console of VM %s", d.MachineName)
+	if err := d.validateVMRef(); err != nil {
+		return nil, err
+	}
+	running, err := d.isRunning()
+	if err != nil {
+		return nil, err
+	}
+	if !running {
+		return nil, drivers.ErrHostIsNotRunning
+	}
+
+	conn, err := d.getConn()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.vm.OpenConsole("", stream, libvirt.DOMAIN_CONSOLE_SAFE); err != nil {
+		_ = stream.Free()
+		var virErr libvirt.Error
+		if errors.As(err, &virErr) && virErr.Code == libvirt.ERR_OPERATION_FAILED {
+			return nil, fmt.Errorf("The console of VM %s is already in use: %w", d.MachineName, err)
+		}
+		return nil, err
+	}
+
+	return &consoleStream{stream: stream}, nil
+}
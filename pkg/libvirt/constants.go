@@ -1,5 +1,7 @@
 package libvirt
 
+import "time"
+
 const (
 	DriverName    = "libvirt"
 	DriverVersion = "0.13.9"
@@ -7,4 +9,101 @@ const (
 	connectionString = "qemu:///system"
 	DefaultNetwork   = "crc"
 	DefaultPool      = "crc"
+	DefaultSSHPort   = 22
+
+	// MinLibvirtVersion is the oldest supported libvirt version, encoded
+	// as major * 1,000,000 + minor * 1,000 + release
+	MinLibvirtVersion = 6000000
+
+	FirmwareBIOS    = "bios"
+	FirmwareEFI     = "efi"
+	DefaultFirmware = FirmwareEFI
+
+	GraphicsNone    = "none"
+	GraphicsVNC     = "vnc"
+	GraphicsSpice   = "spice"
+	DefaultGraphics = GraphicsVNC
+
+	VideoModelNone   = "none"
+	VideoModelVirtio = "virtio"
+	VideoModelQXL    = "qxl"
+	VideoModelVGA    = "vga"
+
+	ClockOffsetUTC       = "utc"
+	ClockOffsetLocaltime = "localtime"
+	DefaultClockOffset   = ClockOffsetUTC
+
+	RNGNone    = "none"
+	RNGURandom = "/dev/urandom"
+	RNGRandom  = "/dev/random"
+	DefaultRNG = RNGURandom
+
+	WatchdogNone     = "none"
+	WatchdogReset    = "reset"
+	WatchdogPoweroff = "poweroff"
+	WatchdogPause    = "pause"
+
+	PanicModelISA     = "isa"
+	PanicModelPVPanic = "pvpanic"
+	PanicModelHyperV  = "hyperv"
+
+	LifecycleDestroy         = "destroy"
+	LifecycleRestart         = "restart"
+	LifecyclePreserve        = "preserve"
+	LifecycleCoredumpDestroy = "coredump-destroy"
+	LifecycleCoredumpRestart = "coredump-restart"
+
+	ImageFormatQcow2 = "qcow2"
+
+	PreallocationOff      = "off"
+	PreallocationMetadata = "metadata"
+	PreallocationFalloc   = "falloc"
+	PreallocationFull     = "full"
+
+	DefaultSMBIOSManufacturer = "Red Hat"
+	DefaultSMBIOSProduct      = "CRC"
+
+	DiskBusVirtio  = "virtio"
+	DiskBusSATA    = "sata"
+	DiskBusSCSI    = "scsi"
+	DefaultDiskBus = DiskBusVirtio
+
+	DiskDiscardIgnore = "ignore"
+	DiskDiscardUnmap  = "unmap"
+
+	CPUModeHostPassthrough = "host-passthrough"
+	CPUModeHostModel       = "host-model"
+	CPUModeCustom          = "custom"
+	DefaultCPUMode         = CPUModeHostPassthrough
+
+	NetworkModeNetwork = "network"
+	NetworkModeBridge  = "bridge"
+	NetworkModeDirect  = "direct"
+	NetworkModeUser    = "user"
+	DefaultNetworkMode = NetworkModeNetwork
+
+	BootDeviceHD      = "hd"
+	BootDeviceCDROM   = "cdrom"
+	BootDeviceNetwork = "network"
+
+	NICModelVirtio  = "virtio"
+	NICModelE1000   = "e1000"
+	NICModelE1000e  = "e1000e"
+	NICModelRTL8139 = "rtl8139"
+	DefaultNICModel = NICModelVirtio
+
+	SharedDirVirtiofs = "virtiofs"
+	SharedDir9p       = "9p"
+
+	// ramDiskDir is the tmpfs directory holding the VM disks when they are
+	// kept in memory
+	ramDiskDir = "/dev/shm"
+	// ramDiskPoolPrefix is the prefix of the names of the RAM disk storage
+	// pools, which are dedicated to a VM
+	ramDiskPoolPrefix = "crc-ram-"
+
+	defaultStartTimeout   = 180 * time.Second
+	defaultSSHTimeout     = 120 * time.Second
+	defaultAgentTimeout   = 5 * time.Second
+	defaultConnectRetries = 2
 )
@@ -0,0 +1,88 @@
+package libvirt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirt"
+)
+
+// checkWritableDir checks a file can be created in dir
+func checkWritableDir(dir string) error {
+	f, err := os.CreateTemp(dir, ".crc-write-check-")
+	if err != nil {
+		return fmt.Errorf("Directory %s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// CoreDump writes the memory of the VM to path for offline analysis, the dump
+// is about as large as the VM memory. The VM is paused during the dump unless
+// live is true, a live dump takes longer and may be inconsistent.
+func (d *Driver) CoreDump(path string, live bool) error {
+	log.Debugf("Dumping memory of VM %s to %s (live: %t)", d.MachineName, path, live)
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	if err := checkWritableDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	var flags libvirt.DomainCoreDumpFlags
+	if live {
+		flags |= libvirt.DUMP_LIVE
+	}
+	if err := d.vm.CoreDump(path, flags); err != nil {
+		return fmt.Errorf("Failed to dump VM memory: %w", err)
+	}
+	return nil
+}
+
+// Screenshot saves the content of the screen of the running VM to dst. The
+// image format is chosen by the hypervisor, usually PPM or PNG.
+func (d *Driver) Screenshot(screen uint, dst string) error {
+	log.Debugf("Taking screenshot of VM %s", d.MachineName)
+	if d.getGraphics() == GraphicsNone {
+		return fmt.Errorf("VM %s has no graphics device", d.MachineName)
+	}
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	if err := d.checkRunning(); err != nil {
+		return err
+	}
+	conn, err := d.getConn()
+	if err != nil {
+		return err
+	}
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return err
+	}
+	defer stream.Free() // nolint:errcheck
+
+	mimeType, err := d.vm.Screenshot(stream, uint32(screen), 0)
+	if err != nil {
+		return fmt.Errorf("Failed to take screenshot: %w", err)
+	}
+	log.Debugf("Screenshot of VM %s is %s", d.MachineName, mimeType)
+
+	f, err := os.Create(dst)
+	if err != nil {
+		_ = stream.Abort()
+		return err
+	}
+	defer f.Close()
+	if err := stream.RecvAll(func(_ *libvirt.Stream, buf []byte) (int, error) {
+		return f.Write(buf)
+	}); err != nil {
+		_ = stream.Abort()
+		return fmt.Errorf("Failed to receive screenshot: %w", err)
+	}
+	if err := stream.Finish(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,25 @@
+package libvirt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckWritableDir(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, checkWritableDir(dir))
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	assert.Error(t, checkWritableDir(filepath.Join(dir, "missing")))
+}
+
+func TestScreenshotWithoutGraphics(t *testing.T) {
+	d := testDriver()
+	d.Graphics = GraphicsNone
+	assert.ErrorContains(t, d.Screenshot(0, filepath.Join(t.TempDir(), "screen.ppm")), "no graphics device")
+}
@@ -1,7 +1,13 @@
 package libvirt
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"libvirt.org/go/libvirt"
 	"libvirt.org/go/libvirtxml"
@@ -9,37 +15,29 @@ import (
 	"github.com/crc-org/machine/libmachine/drivers"
 )
 
-const macAddress = "52:fd:fc:07:21:82"
+const (
+	macAddress = "52:fd:fc:07:21:82"
+	// ignitionFWCfgName is the fw_cfg key ignition reads its config from
+	ignitionFWCfgName = "opt/com.coreos/config"
+)
 
 func domainXML(d *Driver, machineType string) (string, error) {
 	domain := libvirtxml.Domain{
 		Type: "kvm",
 		Name: d.MachineName,
 		Memory: &libvirtxml.DomainMemory{
-			Value: uint(d.Memory),
+			Value: uint(d.getMaxMemory(d.Memory)),
 			Unit:  "MiB",
 		},
 		VCPU: &libvirtxml.DomainVCPU{
-			Value: uint(d.CPU),
+			Value: uint(d.getMaxCPU(d.CPU)),
 		},
 		Features: &libvirtxml.DomainFeatureList{
 			ACPI: &libvirtxml.DomainFeature{},
 			APIC: &libvirtxml.DomainFeatureAPIC{},
 			PAE:  &libvirtxml.DomainFeature{},
 		},
-		CPU: &libvirtxml.DomainCPU{
-			Mode: "host-passthrough",
-		},
 		OS: &libvirtxml.DomainOS{
-			Firmware: "efi",
-			FirmwareInfo: &libvirtxml.DomainOSFirmwareInfo{
-				Features: []libvirtxml.DomainOSFirmwareFeature{
-					{
-						Name:    "secure-boot",
-						Enabled: "no",
-					},
-				},
-			},
 			Type: &libvirtxml.DomainOSType{
 				Type: "hvm",
 			},
@@ -53,15 +51,28 @@ func domainXML(d *Driver, machineType string) (string, error) {
 			},
 		},
 		Clock: &libvirtxml.DomainClock{
-			Offset: "utc",
+			Offset: d.getClockOffset(),
+			Timer: []libvirtxml.DomainTimer{
+				{
+					Name:       "rtc",
+					TickPolicy: "catchup",
+				},
+				{
+					Name:       "pit",
+					TickPolicy: "delay",
+				},
+			},
 		},
 		Devices: &libvirtxml.DomainDeviceList{
 			Disks: []libvirtxml.DomainDisk{
 				{
 					Device: "disk",
 					Driver: &libvirtxml.DomainDiskDriver{
-						Name: "qemu",
-						Type: "qcow2",
+						Name:    "qemu",
+						Type:    "qcow2",
+						Cache:   d.getDiskCacheMode(),
+						IO:      d.getDiskIOMode(),
+						Discard: d.getDiskDiscard(),
 					},
 					Source: &libvirtxml.DomainDiskSource{
 						File: &libvirtxml.DomainDiskSourceFile{
@@ -69,73 +80,140 @@ func domainXML(d *Driver, machineType string) (string, error) {
 						},
 					},
 					Target: &libvirtxml.DomainDiskTarget{
-						Dev: "vda",
-						Bus: "virtio",
+						Dev: d.getDiskTarget(),
+						Bus: d.getDiskBus(),
 					},
-				},
-			},
-			Graphics: []libvirtxml.DomainGraphic{
-				{
-					VNC: &libvirtxml.DomainGraphicVNC{},
+					IOTune: d.diskIOTune(),
 				},
 			},
 			Consoles: []libvirtxml.DomainConsole{
 				{
 					Source: &libvirtxml.DomainChardevSource{
-						StdIO: &libvirtxml.DomainChardevSourceStdIO{},
+						Pty: &libvirtxml.DomainChardevSourcePty{},
 					},
-				},
-			},
-			RNGs: []libvirtxml.DomainRNG{
-				{
-					Model: "virtio",
-					Backend: &libvirtxml.DomainRNGBackend{
-						Random: &libvirtxml.DomainRNGBackendRandom{
-							Device: "/dev/urandom",
-						},
+					// The log file is truncated every time the VM starts
+					Log: &libvirtxml.DomainChardevLog{
+						File:   d.GetConsoleLogPath(),
+						Append: "off",
 					},
 				},
 			},
-			MemBalloon: &libvirtxml.DomainMemBalloon{
-				Model: "none",
-			},
+			MemBalloon: d.memBalloon(),
 		},
 	}
+	cpu, err := d.cpu()
+	if err != nil {
+		return "", err
+	}
+	domain.CPU = cpu
+	if d.getMaxCPU(d.CPU) != d.CPU {
+		domain.VCPU.Current = uint(d.CPU)
+	}
+	if d.getMaxMemory(d.Memory) != d.Memory {
+		// The guest starts with the maximum memory, the balloon then
+		// gives back the memory above the current size
+		domain.CurrentMemory = &libvirtxml.DomainCurrentMemory{
+			Value: uint(d.Memory),
+			Unit:  "MiB",
+		}
+	}
+	domain.CPUTune = d.cpuTune()
+	domain.MemoryTune = d.memoryTune()
+	domain.NUMATune = d.numaTune()
+	metadata, err := d.domainMetadata()
+	if err != nil {
+		return "", err
+	}
+	domain.Metadata = metadata
+	hostdevs, err := d.pciHostdevs()
+	if err != nil {
+		return "", err
+	}
+	usbHostdevs, err := d.usbHostdevs()
+	if err != nil {
+		return "", err
+	}
+	domain.Devices.Hostdevs = append(hostdevs, usbHostdevs...)
+	if d.getDiskBus() == DiskBusSCSI {
+		domain.Devices.Controllers = []libvirtxml.DomainController{
+			{
+				Type:  "scsi",
+				Model: "virtio-scsi",
+			},
+		}
+	}
+	// libvirt picks the emulator matching the domain type when unset
+	domain.Devices.Emulator = d.EmulatorPath
+	if d.ExtraDiskSize != 0 {
+		domain.Devices.Disks = append(domain.Devices.Disks, d.extraDisk())
+	}
+	d.setIOThreads(&domain)
+	if d.ISOPath != "" {
+		domain.Devices.Disks = append(domain.Devices.Disks, cdromDevice(d.ISOPath))
+	}
 	if machineType != "" {
 		domain.OS.Type.Machine = machineType
 	}
-	if d.Network != "" {
-		domain.Devices.Interfaces = []libvirtxml.DomainInterface{
-			{
-				MAC: &libvirtxml.DomainInterfaceMAC{
-					Address: macAddress,
+	domain.OnCrash = d.OnCrash
+	domain.OnPoweroff = d.OnPoweroff
+	domain.OnReboot = d.OnReboot
+	if d.Kernel != "" {
+		domain.OS.Kernel = d.Kernel
+		domain.OS.Initrd = d.Initrd
+		domain.OS.Cmdline = d.Cmdline
+	}
+	if d.getFirmware() == FirmwareEFI {
+		domain.OS.Firmware = FirmwareEFI
+		domain.OS.FirmwareInfo = &libvirtxml.DomainOSFirmwareInfo{
+			Features: []libvirtxml.DomainOSFirmwareFeature{
+				{
+					Name:    "secure-boot",
+					Enabled: "no",
 				},
-				Source: &libvirtxml.DomainInterfaceSource{
-					Network: &libvirtxml.DomainInterfaceSourceNetwork{
-						Network: d.Network,
-					},
+			},
+		}
+		if d.SecureBoot {
+			// libvirt autoselects a secure boot capable firmware and
+			// the matching NVRAM template with pre-enrolled keys
+			domain.OS.FirmwareInfo.Features = []libvirtxml.DomainOSFirmwareFeature{
+				{
+					Name:    "enrolled-keys",
+					Enabled: "yes",
 				},
-				Model: &libvirtxml.DomainInterfaceModel{
-					Type: "virtio",
+				{
+					Name:    "secure-boot",
+					Enabled: "yes",
 				},
-			},
+			}
+			domain.OS.Loader = &libvirtxml.DomainLoader{
+				Secure: "yes",
+			}
+			domain.Features.SMM = &libvirtxml.DomainFeatureSMM{
+				State: "on",
+			}
 		}
 	}
-	if virtiofsSupported(d.conn) == nil && len(d.SharedDirs) != 0 {
-		domain.MemoryBacking = &libvirtxml.DomainMemoryBacking{
-			MemorySource: &libvirtxml.DomainMemorySource{
-				Type: "memfd",
-			},
-			MemoryAccess: &libvirtxml.DomainMemoryAccess{
-				Mode: "shared",
-			},
+	if d.hasNetwork() {
+		domain.Devices.Interfaces = []libvirtxml.DomainInterface{d.interfaceDevice()}
+	}
+	// The guest agent is needed to get the IP address of the VM when it is
+	// not on a libvirt network, and to get or set the guest time
+	domain.Devices.Channels = []libvirtxml.DomainChannel{guestAgentChannel()}
+	if len(d.SharedDirs) != 0 {
+		sharedDirType := d.getSharedDirType()
+		if sharedDirType == SharedDirVirtiofs {
+			domain.MemoryBacking = &libvirtxml.DomainMemoryBacking{
+				MemorySource: &libvirtxml.DomainMemorySource{
+					Type: "memfd",
+				},
+				MemoryAccess: &libvirtxml.DomainMemoryAccess{
+					Mode: "shared",
+				},
+			}
 		}
 		for _, sharedDir := range d.SharedDirs {
 			filesystem := libvirtxml.DomainFilesystem{
 				AccessMode: "passthrough",
-				Driver: &libvirtxml.DomainFilesystemDriver{
-					Type: "virtiofs",
-				},
 				Source: &libvirtxml.DomainFilesystemSource{
 					Mount: &libvirtxml.DomainFilesystemSourceMount{
 						Dir: sharedDir.Source,
@@ -145,10 +223,94 @@ func domainXML(d *Driver, machineType string) (string, error) {
 					Dir: sharedDir.Tag,
 				},
 			}
+			if sharedDirType == SharedDirVirtiofs {
+				filesystem.Driver = &libvirtxml.DomainFilesystemDriver{
+					Type: "virtiofs",
+				}
+			} else if sharedDir.ReadOnly {
+				filesystem.ReadOnly = &libvirtxml.DomainFilesystemReadOnly{}
+			}
 			domain.Devices.Filesystems = append(domain.Devices.Filesystems, filesystem)
 		}
 	}
 
+	if graphics := graphicsDevice(d.getGraphics(), d.GraphicsListen); graphics != nil {
+		domain.Devices.Graphics = []libvirtxml.DomainGraphic{*graphics}
+	}
+	if model := d.getVideoModel(); model != "" {
+		domain.Devices.Videos = []libvirtxml.DomainVideo{
+			{
+				Model: libvirtxml.DomainVideoModel{
+					Type: model,
+					VRam: d.VideoVRAM,
+				},
+			},
+		}
+	}
+
+	// Without it, the first boot can stall waiting for entropy
+	if rng := d.getRNG(); rng != RNGNone {
+		domain.Devices.RNGs = []libvirtxml.DomainRNG{
+			{
+				Model: "virtio",
+				Backend: &libvirtxml.DomainRNGBackend{
+					Random: &libvirtxml.DomainRNGBackendRandom{
+						Device: rng,
+					},
+				},
+			},
+		}
+	}
+
+	if d.PanicDevice != "" {
+		domain.Devices.Panics = []libvirtxml.DomainPanic{
+			{
+				Model: d.PanicDevice,
+			},
+		}
+	}
+
+	if d.Watchdog != "" && d.Watchdog != WatchdogNone {
+		domain.Devices.Watchdogs = []libvirtxml.DomainWatchdog{
+			{
+				Model:  "i6300esb",
+				Action: d.Watchdog,
+			},
+		}
+	}
+
+	if d.TPM {
+		domain.Devices.TPMs = []libvirtxml.DomainTPM{
+			{
+				Model: "tpm-crb",
+				Backend: &libvirtxml.DomainTPMBackend{
+					Emulator: &libvirtxml.DomainTPMBackendEmulator{
+						Version: "2.0",
+					},
+				},
+			},
+		}
+	}
+
+	domain.SysInfo = []libvirtxml.DomainSysInfo{d.smbiosSysInfo()}
+	domain.OS.SMBios = &libvirtxml.DomainSMBios{
+		Mode: "sysinfo",
+	}
+	// libvirt rejects a sysinfo UUID which differs from the domain UUID
+	domain.UUID = d.SMBIOSUUID
+	if d.IgnitionPath != "" {
+		domain.SysInfo = append(domain.SysInfo, libvirtxml.DomainSysInfo{
+			FWCfg: &libvirtxml.DomainSysInfoFWCfg{
+				Entry: []libvirtxml.DomainSysInfoEntry{
+					{
+						Name: ignitionFWCfgName,
+						File: d.IgnitionPath,
+					},
+				},
+			},
+		})
+	}
+
 	if d.VSock {
 		domain.Devices.VSock = &libvirtxml.DomainVSock{
 			Model: "virtio",
@@ -157,28 +319,370 @@ func domainXML(d *Driver, machineType string) (string, error) {
 			},
 		}
 	}
+	if err := d.setBootOrder(&domain); err != nil {
+		return "", err
+	}
 	return domain.Marshal()
 }
 
-func virtiofsSupported(conn *libvirt.Connect) error {
-	if conn == nil {
-		return drivers.ErrNotSupported
+func (d *Driver) cpu() (*libvirtxml.DomainCPU, error) {
+	cpu := &libvirtxml.DomainCPU{
+		Mode: d.getCPUMode(),
+	}
+	if cpu.Mode == CPUModeCustom {
+		cpu.Match = "exact"
+		cpu.Model = &libvirtxml.DomainCPUModel{
+			Fallback: "forbid",
+			Value:    d.CPUModel,
+		}
+	}
+	cpu.Numa = d.numa()
+	if d.Nested {
+		_, feature, err := hostKVMModule()
+		if err != nil {
+			return nil, err
+		}
+		cpu.Features = []libvirtxml.DomainCPUFeature{
+			{
+				Policy: "require",
+				Name:   feature,
+			},
+		}
+	}
+	return cpu, nil
+}
+
+// memBalloon returns the balloon device of the VM, it is needed to change
+// the memory size of the running VM and to get memory statistics from the
+// guest
+func (d *Driver) memBalloon() *libvirtxml.DomainMemBalloon {
+	if !d.hasMemBalloon() {
+		return &libvirtxml.DomainMemBalloon{
+			Model: "none",
+		}
+	}
+	balloon := &libvirtxml.DomainMemBalloon{
+		Model: "virtio",
+	}
+	if d.MemoryStatsPeriod > 0 {
+		balloon.Stats = &libvirtxml.DomainMemBalloonStats{
+			Period: uint(d.MemoryStatsPeriod),
+		}
+	}
+	return balloon
+}
+
+// hasMemBalloonDevice returns true when the domain has a balloon device,
+// which is needed to change its memory size while it runs
+func hasMemBalloonDevice(xmldoc string) (bool, error) {
+	var domain libvirtxml.Domain
+	if err := domain.Unmarshal(xmldoc); err != nil {
+		return false, err
+	}
+	if domain.Devices == nil || domain.Devices.MemBalloon == nil {
+		// libvirt adds a balloon by default
+		return true, nil
+	}
+	return domain.Devices.MemBalloon.Model != "none", nil
+}
+
+// setIOThreads adds the IO threads to the domain and assigns the disks to
+// them, the extra disk gets its own thread when there are several
+func (d *Driver) setIOThreads(domain *libvirtxml.Domain) {
+	if d.IOThreads == 0 {
+		return
+	}
+	domain.IOThreads = d.IOThreads
+	if d.getDiskBus() == DiskBusSCSI {
+		// The disks share the thread of their controller
+		for i := range domain.Devices.Controllers {
+			domain.Devices.Controllers[i].Driver = &libvirtxml.DomainControllerDriver{
+				IOThread: 1,
+			}
+		}
+		return
+	}
+	for i := range domain.Devices.Disks {
+		iothread := uint(i + 1)
+		if iothread > d.IOThreads {
+			iothread = d.IOThreads
+		}
+		domain.Devices.Disks[i].Driver.IOThread = &iothread
+	}
+}
+
+func (d *Driver) extraDisk() libvirtxml.DomainDisk {
+	disk := libvirtxml.DomainDisk{
+		Device: "disk",
+		Driver: &libvirtxml.DomainDiskDriver{
+			Name: "qemu",
+			Type: "qcow2",
+		},
+		Source: &libvirtxml.DomainDiskSource{
+			File: &libvirtxml.DomainDiskSourceFile{
+				File: d.GetExtraDiskPath(),
+			},
+		},
+		Target: &libvirtxml.DomainDiskTarget{
+			Dev: d.getExtraDiskTarget(),
+			Bus: d.getDiskBus(),
+		},
+	}
+	if d.ExtraDiskShareable {
+		// libvirt requires host caching to be disabled on disks shared
+		// between VMs
+		disk.Driver.Cache = "none"
+		disk.Shareable = &libvirtxml.DomainDiskShareable{}
+	}
+	if d.ExtraDiskReadOnly {
+		disk.ReadOnly = &libvirtxml.DomainDiskReadOnly{}
+	}
+	return disk
+}
+
+// setBootOrder sets the boot order on the devices listed in BootOrder. The
+// per-device boot elements cannot be used together with the os ones.
+func (d *Driver) setBootOrder(domain *libvirtxml.Domain) error {
+	if len(d.BootOrder) == 0 {
+		return nil
 	}
+	domain.OS.BootDevices = nil
+	for i, dev := range d.BootOrder {
+		boot := &libvirtxml.DomainDeviceBoot{Order: uint(i + 1)}
+		found := false
+		switch dev {
+		case BootDeviceHD, BootDeviceCDROM:
+			device := "disk"
+			if dev == BootDeviceCDROM {
+				device = "cdrom"
+			}
+			for j := range domain.Devices.Disks {
+				if domain.Devices.Disks[j].Device == device {
+					domain.Devices.Disks[j].Boot = boot
+					found = true
+					break
+				}
+			}
+		case BootDeviceNetwork:
+			if len(domain.Devices.Interfaces) != 0 {
+				domain.Devices.Interfaces[0].Boot = boot
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Cannot boot from %s, the VM has no such device", dev)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) interfaceDevice() libvirtxml.DomainInterface {
+	iface := libvirtxml.DomainInterface{
+		MAC: &libvirtxml.DomainInterfaceMAC{
+			Address: macAddress,
+		},
+		Source: &libvirtxml.DomainInterfaceSource{},
+		Model: &libvirtxml.DomainInterfaceModel{
+			Type: d.getNICModel(),
+		},
+		Bandwidth: d.interfaceBandwidth(),
+	}
+	switch d.getNetworkMode() {
+	case NetworkModeBridge:
+		iface.Source.Bridge = &libvirtxml.DomainInterfaceSourceBridge{
+			Bridge: d.Network,
+		}
+	case NetworkModeDirect:
+		iface.Source.Direct = &libvirtxml.DomainInterfaceSourceDirect{
+			Dev:  d.HostInterface,
+			Mode: "bridge",
+		}
+	case NetworkModeUser:
+		iface.Source.User = &libvirtxml.DomainInterfaceSourceUser{}
+		// libvirt only supports port forwarding with the passt backend
+		iface.Backend = &libvirtxml.DomainInterfaceBackend{
+			Type: "passt",
+		}
+		iface.PortForward = d.portForwards()
+	default:
+		iface.Source.Network = &libvirtxml.DomainInterfaceSourceNetwork{
+			Network: d.Network,
+		}
+	}
+	return iface
+}
+
+func guestAgentChannel() libvirtxml.DomainChannel {
+	return libvirtxml.DomainChannel{
+		Source: &libvirtxml.DomainChardevSource{
+			UNIX: &libvirtxml.DomainChardevSourceUNIX{},
+		},
+		Target: &libvirtxml.DomainChannelTarget{
+			VirtIO: &libvirtxml.DomainChannelTargetVirtIO{
+				Name: "org.qemu.guest_agent.0",
+			},
+		},
+	}
+}
+
+func graphicsDevice(graphics, listen string) *libvirtxml.DomainGraphic {
+	var listeners []libvirtxml.DomainGraphicListener
+	if listen != "" {
+		listeners = []libvirtxml.DomainGraphicListener{
+			{
+				Address: &libvirtxml.DomainGraphicListenerAddress{
+					Address: listen,
+				},
+			},
+		}
+	}
+	switch graphics {
+	case GraphicsVNC:
+		return &libvirtxml.DomainGraphic{
+			VNC: &libvirtxml.DomainGraphicVNC{
+				Listeners: listeners,
+			},
+		}
+	case GraphicsSpice:
+		return &libvirtxml.DomainGraphic{
+			Spice: &libvirtxml.DomainGraphicSpice{
+				Listeners: listeners,
+			},
+		}
+	default:
+		return nil
+	}
+}
 
+// GetDomainXML returns the XML definition of the domain as libvirt currently
+// runs it, for debugging purposes
+func (d *Driver) GetDomainXML() (string, error) {
+	if err := d.validateVMRef(); err != nil {
+		return "", err
+	}
+	return d.vm.GetXMLDesc(0)
+}
+
+// GetGeneratedXML returns the XML definition the driver would use to define
+// the domain with its current configuration, it can be compared with
+// GetDomainXML to find out about differences
+func (d *Driver) GetGeneratedXML() (string, error) {
+	conn, err := d.getConn()
+	if err != nil {
+		return "", err
+	}
 	guest, err := getBestGuestFromCaps(conn)
 	if err != nil {
-		return err
+		return "", err
 	}
+	machineType, err := d.machineType(guest)
+	if err != nil {
+		return "", err
+	}
+	return domainXML(d, machineType)
+}
 
-	domainCapsXML, err := conn.GetDomainCapabilities(guest.Arch.Emulator, guest.Arch.Name, getMachineType(guest), "kvm", 0)
+// GetGraphicsPort returns the port the VNC or SPICE server of the running VM
+// is listening on
+func (d *Driver) GetGraphicsPort() (int, error) {
+	if err := d.validateVMRef(); err != nil {
+		return 0, err
+	}
+	xmldoc, err := d.vm.GetXMLDesc(0)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	var domain libvirtxml.Domain
+	if err := domain.Unmarshal(xmldoc); err != nil {
+		return 0, err
+	}
+	if domain.Devices != nil {
+		for _, graphics := range domain.Devices.Graphics {
+			if graphics.VNC != nil && graphics.VNC.Port > 0 {
+				return graphics.VNC.Port, nil
+			}
+			if graphics.Spice != nil && graphics.Spice.Port > 0 {
+				return graphics.Spice.Port, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("No graphics port found for VM %s, is it running with graphics enabled?", d.MachineName)
+}
+
+// GetVsockCID returns the context ID libvirt assigned to the vsock device of
+// the running VM
+func (d *Driver) GetVsockCID() (uint32, error) {
+	if err := d.validateVMRef(); err != nil {
+		return 0, err
+	}
+	xmldoc, err := d.vm.GetXMLDesc(0)
+	if err != nil {
+		return 0, err
+	}
+	return vsockCID(xmldoc)
+}
+
+func vsockCID(xmldoc string) (uint32, error) {
+	var domain libvirtxml.Domain
+	if err := domain.Unmarshal(xmldoc); err != nil {
+		return 0, err
+	}
+	if domain.Devices == nil || domain.Devices.VSock == nil || domain.Devices.VSock.CID == nil {
+		return 0, errors.New("The VM has no vsock device")
+	}
+	if domain.Devices.VSock.CID.Address == "" {
+		return 0, errors.New("No vsock CID assigned to the VM, is it running?")
+	}
+	cid, err := strconv.ParseUint(domain.Devices.VSock.CID.Address, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid vsock CID '%s': %w", domain.Devices.VSock.CID.Address, err)
+	}
+	return uint32(cid), nil
+}
+
+func getDomainCaps(conn *libvirt.Connect) (*libvirtxml.DomainCaps, error) {
+	guest, err := getBestGuestFromCaps(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	domainCapsXML, err := conn.GetDomainCapabilities(guest.Arch.Emulator, guest.Arch.Name, defaultMachineType(guest), "kvm", 0)
+	if err != nil {
+		return nil, err
 	}
 
 	caps := &libvirtxml.DomainCaps{}
 	err = caps.Unmarshal(domainCapsXML)
 	if err != nil {
-		return fmt.Errorf("Error parsing libvirt domain capabilities: %w", err)
+		return nil, fmt.Errorf("Error parsing libvirt domain capabilities: %w", err)
+	}
+
+	return caps, nil
+}
+
+func enumHasValue(enums []libvirtxml.DomainCapsEnum, name, value string) bool {
+	for _, enum := range enums {
+		if enum.Name != name {
+			continue
+		}
+		for _, val := range enum.Values {
+			if val == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func virtiofsSupported(conn *libvirt.Connect) error {
+	if conn == nil {
+		return drivers.ErrNotSupported
+	}
+
+	caps, err := getDomainCaps(conn)
+	if err != nil {
+		return err
 	}
 
 	if caps.Devices.FileSystem == nil {
@@ -188,16 +692,124 @@ func virtiofsSupported(conn *libvirt.Connect) error {
 	if caps.Devices.FileSystem.Supported != "yes" {
 		return drivers.ErrNotSupported
 	}
-	for _, enum := range caps.Devices.FileSystem.Enums {
-		if enum.Name != "driverType" {
-			continue
-		}
-		for _, val := range enum.Values {
-			if val == "virtiofs" {
-				return nil
-			}
+	if !enumHasValue(caps.Devices.FileSystem.Enums, "driverType", "virtiofs") {
+		return drivers.ErrNotSupported
+	}
+	// virtiofs needs the guest memory to be shared with virtiofsd
+	if caps.MemoryBacking != nil && !enumHasValue(caps.MemoryBacking.Enums, "sourceType", "memfd") {
+		return drivers.ErrNotSupported
+	}
+
+	return nil
+}
+
+// getSharedDirType returns the filesystem used to share directories with the
+// VM, virtiofs is preferred and 9p is used when it's not supported or when no
+// libvirt connection is open
+func (d *Driver) getSharedDirType() string {
+	if virtiofsSupported(d.getOpenConn()) == nil {
+		return SharedDirVirtiofs
+	}
+	return SharedDir9p
+}
+
+// virtiofsdPaths are the locations where distributions install virtiofsd
+// outside of $PATH
+var virtiofsdPaths = []string{
+	"/usr/libexec/virtiofsd",
+	"/usr/lib/qemu/virtiofsd",
+}
+
+func virtiofsdAvailable() error {
+	if _, err := exec.LookPath("virtiofsd"); err == nil {
+		return nil
+	}
+	for _, path := range virtiofsdPaths {
+		if _, err := os.Stat(path); err == nil {
+			return nil
 		}
 	}
+	return errors.New("virtiofsd is required to share directories with the VM, make sure it is installed")
+}
+
+// efiSupported checks if libvirt found an OVMF firmware descriptor which can
+// be used to boot the VM in UEFI mode
+func efiSupported(conn *libvirt.Connect) error {
+	caps, err := getDomainCaps(conn)
+	if err != nil {
+		return err
+	}
+
+	if caps.OS == nil || caps.OS.Supported != "yes" {
+		return drivers.ErrNotSupported
+	}
+	if enumHasValue(caps.OS.Enums, "firmware", FirmwareEFI) {
+		return nil
+	}
 
 	return drivers.ErrNotSupported
 }
+
+// vhostVsockDevice is created by the vhost_vsock kernel module, which is
+// needed to use vsock with KVM
+var vhostVsockDevice = "/dev/vhost-vsock"
+
+func vsockSupported() error {
+	if _, err := os.Stat(vhostVsockDevice); err != nil {
+		return fmt.Errorf("vsock support requires the vhost_vsock kernel module, try 'modprobe vhost_vsock': %w", err)
+	}
+	return nil
+}
+
+// sysClassNet lists the network interfaces of the host
+var sysClassNet = "/sys/class/net"
+
+// validateBridge checks the host bridge the VM is connected to exists, its
+// IP configuration is not managed by libvirt so there is nothing else to check
+func validateBridge(bridge string) error {
+	if _, err := os.Stat(filepath.Join(sysClassNet, bridge, "bridge")); err != nil {
+		return fmt.Errorf("%s is not a network bridge of the host: %w", bridge, err)
+	}
+	return nil
+}
+
+func validateHostInterface(dev string) error {
+	if _, err := os.Stat(filepath.Join(sysClassNet, dev)); err != nil {
+		return fmt.Errorf("Host network interface %s not found: %w", dev, err)
+	}
+	return nil
+}
+
+// sysModule lists the kernel modules loaded on the host
+var sysModule = "/sys/module"
+
+// hostKVMModule returns the KVM module of the host CPU vendor, and the CPU
+// feature which enables nested virtualization in the VM
+func hostKVMModule() (string, string, error) {
+	if _, err := os.Stat(filepath.Join(sysModule, "kvm_intel")); err == nil {
+		return "kvm_intel", "vmx", nil
+	}
+	if _, err := os.Stat(filepath.Join(sysModule, "kvm_amd")); err == nil {
+		return "kvm_amd", "svm", nil
+	}
+	return "", "", errors.New("Neither the kvm_intel nor the kvm_amd kernel module is loaded")
+}
+
+// nestedVirtSupported checks nested virtualization is enabled in the KVM
+// module of the host
+func nestedVirtSupported() error {
+	module, _, err := hostKVMModule()
+	if err != nil {
+		return err
+	}
+	nested, err := os.ReadFile(filepath.Join(sysModule, module, "parameters", "nested"))
+	if err != nil {
+		return fmt.Errorf("Cannot check if nested virtualization is enabled: %w", err)
+	}
+	switch strings.TrimSpace(string(nested)) {
+	case "Y", "1":
+		return nil
+	default:
+		return fmt.Errorf("Nested virtualization is disabled on the host, load the %s module with nested=1 to enable it", module)
+	}
+}
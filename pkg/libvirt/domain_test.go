@@ -1,7 +1,10 @@
 package libvirt
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/crc-org/machine/drivers/libvirt"
 	"github.com/crc-org/machine/libmachine/drivers"
@@ -9,6 +12,11 @@ import (
 )
 
 func TestTemplating(t *testing.T) {
+	defer func(now func() time.Time) { timeNow = now }(timeNow)
+	timeNow = func() time.Time {
+		return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	}
+
 	xml, err := domainXML(&Driver{
 		Driver: &libvirt.Driver{
 			VMDriver: &drivers.VMDriver{
@@ -30,8 +38,15 @@ func TestTemplating(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, `<domain type="kvm">
   <name>domain</name>
+  <metadata><crc xmlns="https://crc.dev/machine-driver-libvirt/metadata/1.0"><driverVersion>`+DriverVersion+`</driverVersion><createdAt>2024-01-02T03:04:05Z</createdAt></crc></metadata>
   <memory unit="MiB">4096</memory>
   <vcpu>4</vcpu>
+  <sysinfo type="smbios">
+    <system>
+      <entry name="manufacturer">Red Hat</entry>
+      <entry name="product">CRC</entry>
+    </system>
+  </sysinfo>
   <os firmware="efi">
     <type machine="q35">hvm</type>
     <firmware>
@@ -39,6 +54,7 @@ func TestTemplating(t *testing.T) {
     </firmware>
     <boot dev="hd"></boot>
     <bootmenu enable="no"></bootmenu>
+    <smbios mode="sysinfo"></smbios>
   </os>
   <features>
     <pae></pae>
@@ -46,7 +62,10 @@ func TestTemplating(t *testing.T) {
     <apic></apic>
   </features>
   <cpu mode="host-passthrough"></cpu>
-  <clock offset="utc"></clock>
+  <clock offset="utc">
+    <timer name="rtc" tickpolicy="catchup"></timer>
+    <timer name="pit" tickpolicy="delay"></timer>
+  </clock>
   <devices>
     <disk type="file" device="disk">
       <driver name="qemu" type="qcow2"></driver>
@@ -58,7 +77,12 @@ func TestTemplating(t *testing.T) {
       <source network="network"></source>
       <model type="virtio"></model>
     </interface>
-    <console type="stdio"></console>
+    <console type="pty">
+      <log file="machines/domain/domain-console.log" append="off"></log>
+    </console>
+    <channel type="unix">
+      <target type="virtio" name="org.qemu.guest_agent.0"></target>
+    </channel>
     <graphics type="vnc"></graphics>
     <memballoon model="none"></memballoon>
     <rng model="virtio">
@@ -116,3 +140,641 @@ func TestNetworkTemplating(t *testing.T) {
       <model type="virtio"></model>
     </interface>`)
 }
+
+func testDriver() *Driver {
+	return &Driver{
+		Driver: &libvirt.Driver{
+			VMDriver: &drivers.VMDriver{
+				BaseDriver: &drivers.BaseDriver{
+					MachineName: "domain",
+				},
+				ImageSourcePath: "disk_path",
+				ImageFormat:     "test",
+				Memory:          4096,
+				CPU:             4,
+			},
+			Network:   "crc",
+			CacheMode: "default",
+			IOMode:    "threads",
+		},
+	}
+}
+
+func TestBIOSTemplating(t *testing.T) {
+	d := testDriver()
+	d.Firmware = FirmwareBIOS
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<os>
+    <type machine="q35">hvm</type>
+    <boot dev="hd"></boot>`)
+	assert.NotContains(t, xml, "firmware")
+}
+
+func TestSecureBootTemplating(t *testing.T) {
+	d := testDriver()
+	d.SecureBoot = true
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<os firmware="efi">
+    <type machine="q35">hvm</type>
+    <firmware>
+      <feature enabled="yes" name="enrolled-keys"></feature>
+      <feature enabled="yes" name="secure-boot"></feature>
+    </firmware>
+    <loader secure="yes"></loader>`)
+	assert.Contains(t, xml, `<smm state="on"></smm>`)
+}
+
+func TestTPMTemplating(t *testing.T) {
+	d := testDriver()
+	d.TPM = true
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<tpm model="tpm-crb">
+      <backend type="emulator" version="2.0"></backend>
+    </tpm>`)
+}
+
+func TestGraphicsTemplating(t *testing.T) {
+	d := testDriver()
+	d.Graphics = GraphicsNone
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.NotContains(t, xml, "<graphics")
+
+	d.Graphics = GraphicsSpice
+	d.GraphicsListen = "127.0.0.1"
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<graphics type="spice">
+      <listen type="address" address="127.0.0.1"></listen>
+    </graphics>`)
+}
+
+func TestExtraDiskTemplating(t *testing.T) {
+	d := testDriver()
+	d.ExtraDiskSize = 10
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<disk type="file" device="disk">
+      <driver name="qemu" type="qcow2"></driver>
+      <source file="machines/domain/domain-extra.qcow2"></source>
+      <target dev="vdb" bus="virtio"></target>
+    </disk>`)
+}
+
+func TestDiskDiscardTemplating(t *testing.T) {
+	d := testDriver()
+	d.DiskDiscard = DiskDiscardUnmap
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<driver name="qemu" type="qcow2" discard="unmap"></driver>`)
+}
+
+func TestDiskCacheTemplating(t *testing.T) {
+	d := testDriver()
+	d.CacheMode = "none"
+	d.IOMode = "native"
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<driver name="qemu" type="qcow2" cache="none" io="native"></driver>`)
+}
+
+func TestStoragePoolPathTemplating(t *testing.T) {
+	d := testDriver()
+	d.StoragePoolPath = "/var/lib/crc/pool"
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<source file="/var/lib/crc/pool/domain.test"></source>`)
+}
+
+func TestDiskIOTuneTemplating(t *testing.T) {
+	d := testDriver()
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.NotContains(t, xml, "<iotune>")
+
+	d.DiskReadBytesSec = 10485760
+	d.DiskWriteIopsSec = 500
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<iotune>
+        <read_bytes_sec>10485760</read_bytes_sec>
+        <write_iops_sec>500</write_iops_sec>
+      </iotune>`)
+}
+
+func TestNetworkBandwidthTemplating(t *testing.T) {
+	d := testDriver()
+	d.NetOutboundKBps = 1024
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<bandwidth>
+        <outbound average="1024"></outbound>
+      </bandwidth>`)
+	assert.NotContains(t, xml, "<inbound")
+}
+
+func TestIgnitionTemplating(t *testing.T) {
+	d := testDriver()
+	d.IgnitionPath = "/tmp/crc.ign"
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<sysinfo type="fwcfg">
+    <entry name="opt/com.coreos/config" file="/tmp/crc.ign"></entry>
+  </sysinfo>`)
+}
+
+func TestVsockCID(t *testing.T) {
+	cid, err := vsockCID(`<domain><devices><vsock model="virtio"><cid auto="yes" address="3"></cid></vsock></devices></domain>`)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), cid)
+
+	_, err = vsockCID(`<domain><devices><vsock model="virtio"><cid auto="yes"></cid></vsock></devices></domain>`)
+	assert.Error(t, err)
+
+	_, err = vsockCID(`<domain><devices></devices></domain>`)
+	assert.Error(t, err)
+}
+
+func TestVsockSupported(t *testing.T) {
+	orig := vhostVsockDevice
+	defer func() { vhostVsockDevice = orig }()
+
+	vhostVsockDevice = filepath.Join(t.TempDir(), "vhost-vsock")
+	assert.Error(t, vsockSupported())
+	assert.NoError(t, os.WriteFile(vhostVsockDevice, nil, 0600))
+	assert.NoError(t, vsockSupported())
+}
+
+func TestSharedDir9pTemplating(t *testing.T) {
+	d := testDriver()
+	d.SharedDirs = []drivers.SharedDir{
+		{
+			Source:   "/home/user",
+			Tag:      "dir0",
+			ReadOnly: true,
+		},
+	}
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.NotContains(t, xml, "<memoryBacking>")
+	assert.Contains(t, xml, `<filesystem type="mount" accessmode="passthrough">
+      <source dir="/home/user"></source>
+      <target dir="dir0"></target>
+      <readonly></readonly>
+    </filesystem>`)
+}
+
+func TestBridgeTemplating(t *testing.T) {
+	d := testDriver()
+	d.NetworkMode = NetworkModeBridge
+	d.Network = "br0"
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<interface type="bridge">
+      <mac address="52:fd:fc:07:21:82"></mac>
+      <source bridge="br0"></source>
+      <model type="virtio"></model>
+    </interface>`)
+}
+
+func TestValidateBridge(t *testing.T) {
+	orig := sysClassNet
+	defer func() { sysClassNet = orig }()
+
+	sysClassNet = t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(sysClassNet, "br0", "bridge"), 0700))
+	assert.NoError(t, os.MkdirAll(filepath.Join(sysClassNet, "eth0"), 0700))
+
+	assert.NoError(t, validateBridge("br0"))
+	assert.Error(t, validateBridge("eth0"))
+	assert.Error(t, validateBridge("br1"))
+}
+
+func TestDirectTemplating(t *testing.T) {
+	d := testDriver()
+	d.NetworkMode = NetworkModeDirect
+	d.Network = ""
+	d.HostInterface = "eth0"
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<interface type="direct">
+      <mac address="52:fd:fc:07:21:82"></mac>
+      <source dev="eth0" mode="bridge"></source>
+      <model type="virtio"></model>
+    </interface>`)
+	assert.Contains(t, xml, `<channel type="unix">
+      <target type="virtio" name="org.qemu.guest_agent.0"></target>
+    </channel>`)
+}
+
+func TestValidateHostInterface(t *testing.T) {
+	orig := sysClassNet
+	defer func() { sysClassNet = orig }()
+
+	sysClassNet = t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(sysClassNet, "eth0"), 0700))
+
+	assert.NoError(t, validateHostInterface("eth0"))
+	assert.Error(t, validateHostInterface("eth1"))
+}
+
+func TestCPUModeTemplating(t *testing.T) {
+	d := testDriver()
+	d.CPUMode = CPUModeHostModel
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<cpu mode="host-model"></cpu>`)
+
+	d.CPUMode = CPUModeCustom
+	d.CPUModel = "Skylake-Client"
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<cpu match="exact" mode="custom">
+    <model fallback="forbid">Skylake-Client</model>
+  </cpu>`)
+}
+
+func TestNestedTemplating(t *testing.T) {
+	orig := sysModule
+	defer func() { sysModule = orig }()
+	sysModule = t.TempDir()
+
+	d := testDriver()
+	d.Nested = true
+	_, err := domainXML(d, "q35")
+	assert.Error(t, err)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(sysModule, "kvm_amd"), 0700))
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<cpu mode="host-passthrough">
+    <feature policy="require" name="svm"></feature>
+  </cpu>`)
+}
+
+func TestNestedVirtSupported(t *testing.T) {
+	orig := sysModule
+	defer func() { sysModule = orig }()
+	sysModule = t.TempDir()
+
+	assert.Error(t, nestedVirtSupported())
+
+	parameters := filepath.Join(sysModule, "kvm_intel", "parameters")
+	assert.NoError(t, os.MkdirAll(parameters, 0700))
+	assert.Error(t, nestedVirtSupported())
+
+	assert.NoError(t, os.WriteFile(filepath.Join(parameters, "nested"), []byte("N\n"), 0600))
+	assert.Error(t, nestedVirtSupported())
+
+	assert.NoError(t, os.WriteFile(filepath.Join(parameters, "nested"), []byte("Y\n"), 0600))
+	assert.NoError(t, nestedVirtSupported())
+}
+
+func TestRNGTemplating(t *testing.T) {
+	d := testDriver()
+	d.RNG = RNGRandom
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<rng model="virtio">
+      <backend model="random">/dev/random</backend>
+    </rng>`)
+
+	d.RNG = RNGNone
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.NotContains(t, xml, "<rng")
+}
+
+func TestWatchdogTemplating(t *testing.T) {
+	d := testDriver()
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.NotContains(t, xml, "<watchdog")
+
+	d.Watchdog = WatchdogReset
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<watchdog model="i6300esb" action="reset"></watchdog>`)
+}
+
+func TestClockTemplating(t *testing.T) {
+	d := testDriver()
+	d.ClockOffset = ClockOffsetLocaltime
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<clock offset="localtime">
+    <timer name="rtc" tickpolicy="catchup"></timer>
+    <timer name="pit" tickpolicy="delay"></timer>
+  </clock>`)
+}
+
+func TestEmulatorTemplating(t *testing.T) {
+	d := testDriver()
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.NotContains(t, xml, "<emulator>")
+
+	d.EmulatorPath = "/opt/qemu/bin/qemu-system-x86_64"
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, "<emulator>/opt/qemu/bin/qemu-system-x86_64</emulator>")
+}
+
+func TestMemBalloonTemplating(t *testing.T) {
+	d := testDriver()
+	d.MemoryStatsPeriod = 10
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<memballoon model="virtio">
+      <stats period="10"></stats>
+    </memballoon>`)
+}
+
+func TestMaxMemoryTemplating(t *testing.T) {
+	d := testDriver()
+	d.MaxMemory = 8192
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<memory unit="MiB">8192</memory>
+  <currentMemory unit="MiB">4096</currentMemory>`)
+	assert.Contains(t, xml, `<memballoon model="virtio"></memballoon>`)
+
+	d.MaxMemory = 2048
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<memory unit="MiB">4096</memory>`)
+	assert.NotContains(t, xml, "currentMemory")
+}
+
+func TestMaxCPUTemplating(t *testing.T) {
+	d := testDriver()
+	d.MaxCPU = 8
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<vcpu current="4">8</vcpu>`)
+}
+
+func TestHasMemBalloonDevice(t *testing.T) {
+	balloon, err := hasMemBalloonDevice(`<domain><devices><memballoon model="none"></memballoon></devices></domain>`)
+	assert.NoError(t, err)
+	assert.False(t, balloon)
+
+	balloon, err = hasMemBalloonDevice(`<domain><devices><memballoon model="virtio"></memballoon></devices></domain>`)
+	assert.NoError(t, err)
+	assert.True(t, balloon)
+}
+
+func TestDiskBusTemplating(t *testing.T) {
+	d := testDriver()
+	d.DiskBus = DiskBusSCSI
+	d.ExtraDiskSize = 10
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<target dev="sda" bus="scsi"></target>`)
+	assert.Contains(t, xml, `<target dev="sdb" bus="scsi"></target>`)
+	assert.Contains(t, xml, `<controller type="scsi" model="virtio-scsi"></controller>`)
+
+	d.DiskBus = DiskBusSATA
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<target dev="sda" bus="sata"></target>`)
+	assert.NotContains(t, xml, "<controller")
+}
+
+func TestNICModelTemplating(t *testing.T) {
+	d := testDriver()
+	d.NICModel = NICModelE1000e
+	d.NetworkMode = NetworkModeBridge
+	d.Network = "br0"
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<interface type="bridge">
+      <mac address="52:fd:fc:07:21:82"></mac>
+      <source bridge="br0"></source>
+      <model type="e1000e"></model>
+    </interface>`)
+}
+
+func TestKernelBootTemplating(t *testing.T) {
+	d := testDriver()
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.NotContains(t, xml, "<kernel>")
+
+	d.Kernel = "/boot/vmlinuz"
+	d.Initrd = "/boot/initramfs.img"
+	d.Cmdline = "console=ttyS0"
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<kernel>/boot/vmlinuz</kernel>
+    <initrd>/boot/initramfs.img</initrd>
+    <cmdline>console=ttyS0</cmdline>`)
+}
+
+func TestBootOrderTemplating(t *testing.T) {
+	d := testDriver()
+	d.BootOrder = []string{BootDeviceNetwork, BootDeviceHD}
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.NotContains(t, xml, `<boot dev="hd"></boot>`)
+	assert.Contains(t, xml, `<boot order="1"></boot>`)
+	assert.Contains(t, xml, `<boot order="2"></boot>`)
+
+	d.BootOrder = []string{BootDeviceCDROM, BootDeviceHD}
+	_, err = domainXML(d, "q35")
+	assert.ErrorContains(t, err, "Cannot boot from cdrom")
+}
+
+func TestCDROMTemplating(t *testing.T) {
+	d := testDriver()
+	d.ISOPath = "/var/lib/libvirt/images/install.iso"
+	d.BootOrder = []string{BootDeviceCDROM, BootDeviceHD}
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<disk type="file" device="cdrom">
+      <driver name="qemu" type="raw"></driver>
+      <source file="/var/lib/libvirt/images/install.iso"></source>
+      <target dev="sdc" bus="sata"></target>
+      <readonly></readonly>
+      <boot order="1"></boot>
+    </disk>`)
+}
+
+func TestLifecycleTemplating(t *testing.T) {
+	d := testDriver()
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.NotContains(t, xml, "<on_crash>")
+
+	d.OnCrash = LifecycleCoredumpDestroy
+	d.OnReboot = LifecycleDestroy
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, "<on_reboot>destroy</on_reboot>")
+	assert.Contains(t, xml, "<on_crash>coredump-destroy</on_crash>")
+	assert.NotContains(t, xml, "<on_poweroff>")
+}
+
+func TestVideoTemplating(t *testing.T) {
+	d := testDriver()
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.NotContains(t, xml, "<video>")
+
+	d.Graphics = GraphicsNone
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<video>
+      <model type="none"></model>
+    </video>`)
+
+	d.Graphics = GraphicsSpice
+	d.VideoModel = VideoModelQXL
+	d.VideoVRAM = 65536
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<model type="qxl" vram="65536"></model>`)
+}
+
+func TestPanicDeviceTemplating(t *testing.T) {
+	d := testDriver()
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.NotContains(t, xml, "<panic")
+
+	d.PanicDevice = PanicModelPVPanic
+	d.OnCrash = LifecycleCoredumpDestroy
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<panic model="pvpanic"></panic>`)
+}
+
+func TestCPUTuneTemplating(t *testing.T) {
+	d := testDriver()
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.NotContains(t, xml, "<cputune>")
+
+	d.CPUShares = 512
+	d.CPUQuota = 50000
+	d.CPUPeriod = 100000
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<cputune>
+    <shares>512</shares>
+    <period>100000</period>
+    <quota>50000</quota>
+  </cputune>`)
+}
+
+func TestMemoryTuneTemplating(t *testing.T) {
+	d := testDriver()
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.NotContains(t, xml, "<memtune>")
+
+	d.MemoryHardLimit = 6144
+	d.MemorySoftLimit = 5120
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<memtune>
+    <hard_limit unit="MiB">6144</hard_limit>
+    <soft_limit unit="MiB">5120</soft_limit>
+  </memtune>`)
+}
+
+func TestNUMATemplating(t *testing.T) {
+	d := testDriver()
+	d.NUMANodes = []NUMANode{
+		{CPUs: "0-1", Memory: 2048, HostNodes: "0"},
+		{CPUs: "2-3", Memory: 2048},
+	}
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<cpu mode="host-passthrough">
+    <numa>
+      <cell id="0" cpus="0-1" memory="2048" unit="MiB"></cell>
+      <cell id="1" cpus="2-3" memory="2048" unit="MiB"></cell>
+    </numa>
+  </cpu>`)
+	assert.Contains(t, xml, `<numatune>
+    <memnode cellid="0" mode="strict" nodeset="0"></memnode>
+  </numatune>`)
+}
+
+func TestSharedExtraDiskTemplating(t *testing.T) {
+	d := testDriver()
+	d.ExtraDiskSize = 10
+	d.ExtraDiskShareable = true
+	d.ExtraDiskReadOnly = true
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<disk type="file" device="disk">
+      <driver name="qemu" type="qcow2" cache="none"></driver>
+      <source file="machines/domain/domain-extra.qcow2"></source>
+      <target dev="vdb" bus="virtio"></target>
+      <readonly></readonly>
+      <shareable></shareable>
+    </disk>`)
+}
+
+func TestIOThreadsTemplating(t *testing.T) {
+	d := testDriver()
+	d.IOThreads = 2
+	d.ExtraDiskSize = 10
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<iothreads>2</iothreads>`)
+	assert.Contains(t, xml, `iothread="1"`)
+	assert.Contains(t, xml, `iothread="2"`)
+
+	d.DiskBus = DiskBusSCSI
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<controller type="scsi" model="virtio-scsi">
+      <driver iothread="1"></driver>
+    </controller>`)
+}
+
+func TestSMBIOSTemplating(t *testing.T) {
+	d := testDriver()
+	d.SMBIOSManufacturer = "ACME"
+	d.SMBIOSSerial = "1234"
+	d.SMBIOSUUID = "c7a5fdbd-edaf-9455-926a-d65c16db1809"
+	d.IgnitionPath = "config.ign"
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<uuid>c7a5fdbd-edaf-9455-926a-d65c16db1809</uuid>`)
+	assert.Contains(t, xml, `<sysinfo type="smbios">
+    <system>
+      <entry name="manufacturer">ACME</entry>
+      <entry name="product">CRC</entry>
+      <entry name="serial">1234</entry>
+      <entry name="uuid">c7a5fdbd-edaf-9455-926a-d65c16db1809</entry>
+    </system>
+  </sysinfo>`)
+	assert.Contains(t, xml, `<sysinfo type="fwcfg">`)
+}
+
+func TestUserNetworkTemplating(t *testing.T) {
+	d := testDriver()
+	d.NetworkMode = NetworkModeUser
+	d.Network = ""
+	d.PortForwards = []string{"tcp:2222:22", "udp:5353:53"}
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<interface type="user">
+      <mac address="52:fd:fc:07:21:82"></mac>
+      <portForward proto="tcp">
+        <range start="2222" to="22"></range>
+      </portForward>
+      <portForward proto="udp">
+        <range start="5353" to="53"></range>
+      </portForward>
+      <model type="virtio"></model>
+      <backend type="passt"></backend>
+    </interface>`)
+}
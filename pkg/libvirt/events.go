@@ -0,0 +1,98 @@
+package libvirt
+
+import (
+	"context"
+	"time"
+
+	"github.com/crc-org/machine/libmachine/state"
+	log "github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirt"
+)
+
+// WaitForState waits until the VM reaches the target state, or until ctx is
+// done. The VM state is checked every time libvirt emits a lifecycle event
+// for the domain, and at least once per second.
+//
+// Lifecycle events are only delivered when libvirt.EventRegisterDefaultImpl()
+// has been called before the libvirt connection is opened, and when
+// libvirt.EventRunDefaultImpl() is run in a loop. Without this, or if the
+// event registration fails, the state is only polled.
+func (d *Driver) WaitForState(ctx context.Context, target state.State) error {
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	conn, err := d.getConn()
+	if err != nil {
+		return err
+	}
+
+	changed := make(chan struct{}, 1)
+	callbackID, err := conn.DomainEventLifecycleRegister(d.vm, func(_ *libvirt.Connect, _ *libvirt.Domain, event *libvirt.DomainEventLifecycle) {
+		log.Debugf("VM lifecycle event: %v", event)
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		log.Debugf("Failed to register for lifecycle events, polling VM state: %v", err)
+	} else {
+		defer conn.DomainEventDeregister(callbackID) // nolint:errcheck
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		s, err := d.GetState()
+		if err != nil {
+			log.Debugf("Failed to get VM state: %v", err)
+		}
+		log.Debugf("VM state: %s", s)
+		if err == nil && s == target {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// rebootTimeout is how long Reboot waits for the guest to reset after the
+// reboot request
+var rebootTimeout = 60 * time.Second
+
+// rebootGuest asks the guest to reboot through ACPI and waits for the reset
+// of the VM, which libvirt reports with a reboot event. It returns false when
+// the guest did not reboot before ctx is done. When the event registration
+// fails, the reboot is requested without waiting for it.
+func (d *Driver) rebootGuest(ctx context.Context) (bool, error) {
+	conn, err := d.getConn()
+	if err != nil {
+		return false, err
+	}
+	rebooted := make(chan struct{}, 1)
+	callbackID, err := conn.DomainEventRebootRegister(d.vm, func(_ *libvirt.Connect, _ *libvirt.Domain) {
+		select {
+		case rebooted <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		log.Debugf("Failed to register for reboot events, not waiting for the reboot: %v", err)
+		return true, d.vm.Reboot(libvirt.DOMAIN_REBOOT_ACPI_POWER_BTN)
+	}
+	defer conn.DomainEventDeregister(callbackID) // nolint:errcheck
+
+	if err := d.vm.Reboot(libvirt.DOMAIN_REBOOT_ACPI_POWER_BTN); err != nil {
+		return false, err
+	}
+	select {
+	case <-rebooted:
+		return true, nil
+	case <-ctx.Done():
+		return false, nil
+	}
+}
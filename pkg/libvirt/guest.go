@@ -0,0 +1,196 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirt"
+)
+
+// isGuestAgentError returns true when a libvirt call failed because the
+// guest agent is not configured or not running in the VM
+func isGuestAgentError(err error) bool {
+	var virErr libvirt.Error
+	if !errors.As(err, &virErr) {
+		return false
+	}
+	switch virErr.Code {
+	case libvirt.ERR_AGENT_UNRESPONSIVE, libvirt.ERR_AGENT_UNSYNCED, libvirt.ERR_ARGUMENT_UNSUPPORTED:
+		return true
+	}
+	return false
+}
+
+// guestAgentError wraps err with ErrGuestAgentUnavailable when it is caused
+// by the guest agent not running
+func guestAgentError(err error) error {
+	if isGuestAgentError(err) {
+		return fmt.Errorf("%w: %w", ErrGuestAgentUnavailable, err)
+	}
+	return err
+}
+
+// IsGuestAgentReady returns true when the QEMU guest agent answers a ping
+// within GuestAgentTimeout seconds
+func (d *Driver) IsGuestAgentReady() bool {
+	if err := d.validateVMRef(); err != nil {
+		return false
+	}
+	timeout := libvirt.DomainQemuAgentCommandTimeout(d.getGuestAgentTimeout() / time.Second)
+	if _, err := d.vm.QemuAgentCommand(`{"execute":"guest-ping"}`, timeout, 0); err != nil {
+		log.Debugf("Guest agent of VM %s is not ready: %v", d.MachineName, err)
+		return false
+	}
+	return true
+}
+
+// guestExecPollInterval is the delay between two checks of the status of a
+// command run by the guest agent
+var guestExecPollInterval = 500 * time.Millisecond
+
+type guestExecResult struct {
+	Return struct {
+		PID      int    `json:"pid"`
+		Exited   bool   `json:"exited"`
+		ExitCode int    `json:"exitcode"`
+		ErrData  string `json:"err-data"`
+	} `json:"return"`
+}
+
+// guestExec runs a command in the guest through the guest agent and waits for
+// it to complete, the command stderr is returned in the error when it fails
+func (d *Driver) guestExec(ctx context.Context, path string, args ...string) error {
+	timeout := libvirt.DomainQemuAgentCommandTimeout(d.getGuestAgentTimeout() / time.Second)
+	command, err := json.Marshal(map[string]interface{}{
+		"execute": "guest-exec",
+		"arguments": map[string]interface{}{
+			"path":           path,
+			"arg":            args,
+			"capture-output": true,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	output, err := d.vm.QemuAgentCommand(string(command), timeout, 0)
+	if err != nil {
+		return guestAgentError(err)
+	}
+	var result guestExecResult
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		return fmt.Errorf("Failed to parse guest agent answer: %w", err)
+	}
+
+	status := fmt.Sprintf(`{"execute":"guest-exec-status","arguments":{"pid":%d}}`, result.Return.PID)
+	for {
+		output, err := d.vm.QemuAgentCommand(status, timeout, 0)
+		if err != nil {
+			return guestAgentError(err)
+		}
+		if err := json.Unmarshal([]byte(output), &result); err != nil {
+			return fmt.Errorf("Failed to parse guest agent answer: %w", err)
+		}
+		if result.Return.Exited {
+			break
+		}
+		if err := sleepContext(ctx, guestExecPollInterval); err != nil {
+			return err
+		}
+	}
+	if result.Return.ExitCode != 0 {
+		stderr, _ := base64.StdEncoding.DecodeString(result.Return.ErrData)
+		return fmt.Errorf("%s exited with code %d: %s", path, result.Return.ExitCode, strings.TrimSpace(string(stderr)))
+	}
+	return nil
+}
+
+// growRootScript grows the partition holding the root filesystem of the
+// guest to the end of its disk, then grows the filesystem
+const growRootScript = `set -e
+root=$(findmnt -nvo SOURCE /)
+name=$(basename "$root")
+growpart "/dev/$(lsblk -no PKNAME "$root")" "$(cat "/sys/class/block/$name/partition")" || [ $? -eq 1 ]
+case "$(findmnt -nvo FSTYPE /)" in
+xfs) xfs_growfs / ;;
+ext*) resize2fs "$root" ;;
+esac`
+
+// growGuestFilesystem grows the root filesystem of the guest after its disk
+// was resized, nothing is done when the guest agent is not running
+func (d *Driver) growGuestFilesystem() error {
+	if !d.IsGuestAgentReady() {
+		log.Infof("Guest agent is not running, the root filesystem of VM %s is not grown", d.MachineName)
+		return nil
+	}
+	log.Debugf("Growing root filesystem of VM %s", d.MachineName)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return d.guestExec(ctx, "/bin/sh", "-c", growRootScript)
+}
+
+// GetGuestTime returns the time of the guest clock, it needs the QEMU guest
+// agent
+func (d *Driver) GetGuestTime() (time.Time, error) {
+	if err := d.validateVMRef(); err != nil {
+		return time.Time{}, err
+	}
+	if err := d.checkRunning(); err != nil {
+		return time.Time{}, err
+	}
+	if !d.IsGuestAgentReady() {
+		return time.Time{}, ErrGuestAgentUnavailable
+	}
+	seconds, nseconds, err := d.vm.GetTime(0)
+	if err != nil {
+		return time.Time{}, guestAgentError(err)
+	}
+	return time.Unix(seconds, int64(nseconds)), nil
+}
+
+// SyncGuestTime sets the guest clock to the host time, this is needed after
+// the VM is restored as its clock stopped while it was saved
+func (d *Driver) SyncGuestTime() error {
+	log.Debugf("Synchronizing clock of VM %s", d.MachineName)
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	if err := d.checkRunning(); err != nil {
+		return err
+	}
+	if !d.IsGuestAgentReady() {
+		return fmt.Errorf("Cannot synchronize clock of VM %s: %w", d.MachineName, ErrGuestAgentUnavailable)
+	}
+	if err := d.vm.SetTime(0, 0, libvirt.DOMAIN_TIME_SYNC); err != nil {
+		return fmt.Errorf("Cannot synchronize clock of VM %s: %w", d.MachineName, guestAgentError(err))
+	}
+	return nil
+}
+
+// GetUptime returns for how long the running VM has been up. It is only
+// known for VMs started by this driver.
+func (d *Driver) GetUptime() (time.Duration, error) {
+	if err := d.validateVMRef(); err != nil {
+		return 0, err
+	}
+	if err := d.checkRunning(); err != nil {
+		return 0, err
+	}
+	xmldoc, err := d.vm.GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, metadataNamespace, libvirt.DOMAIN_AFFECT_LIVE)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get metadata of VM %s: %w", d.MachineName, err)
+	}
+	metadata, err := parseMetadata(xmldoc)
+	if err != nil {
+		return 0, err
+	}
+	if metadata.StartedAt == nil {
+		return 0, fmt.Errorf("Start time of VM %s is unknown", d.MachineName)
+	}
+	return timeNow().Sub(*metadata.StartedAt), nil
+}
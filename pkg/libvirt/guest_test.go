@@ -0,0 +1,22 @@
+package libvirt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"libvirt.org/go/libvirt"
+)
+
+func TestGuestAgentError(t *testing.T) {
+	notConnected := libvirt.Error{Code: libvirt.ERR_AGENT_UNRESPONSIVE, Message: "Guest agent is not responding: QEMU guest agent is not connected"}
+	err := guestAgentError(notConnected)
+	assert.ErrorIs(t, err, ErrGuestAgentUnavailable)
+	assert.ErrorIs(t, err, notConnected)
+
+	notConfigured := libvirt.Error{Code: libvirt.ERR_ARGUMENT_UNSUPPORTED, Message: "argument unsupported: QEMU guest agent is not configured"}
+	assert.ErrorIs(t, guestAgentError(notConfigured), ErrGuestAgentUnavailable)
+
+	otherErr := errors.New("operation failed")
+	assert.Equal(t, otherErr, guestAgentError(otherErr))
+}
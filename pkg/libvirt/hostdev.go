@@ -0,0 +1,171 @@
+package libvirt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"libvirt.org/go/libvirtxml"
+)
+
+// sysBusPCI lists the PCI devices of the host
+var sysBusPCI = "/sys/bus/pci/devices"
+
+// sysBusUSB lists the USB devices of the host
+var sysBusUSB = "/sys/bus/usb/devices"
+
+var (
+	pciAddressRegexp = regexp.MustCompile(`^([0-9a-fA-F]{4}):([0-9a-fA-F]{2}):([0-9a-fA-F]{2})\.([0-7])$`)
+	usbIDRegexp      = regexp.MustCompile(`^([0-9a-fA-F]{4}):([0-9a-fA-F]{4})$`)
+)
+
+// parsePCIAddress parses a PCI address in the domain:bus:slot.function
+// format used by lspci -D, for example 0000:01:00.0
+func parsePCIAddress(address string) (*libvirtxml.DomainAddressPCI, error) {
+	matches := pciAddressRegexp.FindStringSubmatch(address)
+	if matches == nil {
+		return nil, fmt.Errorf("Invalid PCI address '%s', expected format is 0000:01:00.0", address)
+	}
+	var fields [4]*uint
+	for i, match := range matches[1:] {
+		value, err := strconv.ParseUint(match, 16, 32)
+		if err != nil {
+			return nil, err
+		}
+		field := uint(value)
+		fields[i] = &field
+	}
+	return &libvirtxml.DomainAddressPCI{
+		Domain:   fields[0],
+		Bus:      fields[1],
+		Slot:     fields[2],
+		Function: fields[3],
+	}, nil
+}
+
+func (d *Driver) pciHostdevs() ([]libvirtxml.DomainHostdev, error) {
+	var hostdevs []libvirtxml.DomainHostdev
+	for _, device := range d.PCIDevices {
+		address, err := parsePCIAddress(device)
+		if err != nil {
+			return nil, err
+		}
+		hostdevs = append(hostdevs, libvirtxml.DomainHostdev{
+			// The device must already be bound to vfio-pci, libvirt
+			// won't change its host driver
+			Managed: "no",
+			SubsysPCI: &libvirtxml.DomainHostdevSubsysPCI{
+				Source: &libvirtxml.DomainHostdevSubsysPCISource{
+					Address: address,
+				},
+			},
+		})
+	}
+	return hostdevs, nil
+}
+
+// validatePCIDevices checks the PCI devices passed to the VM exist and are
+// bound to the vfio-pci driver
+func (d *Driver) validatePCIDevices() error {
+	for _, device := range d.PCIDevices {
+		if _, err := parsePCIAddress(device); err != nil {
+			return err
+		}
+		devicePath := filepath.Join(sysBusPCI, device)
+		if _, err := os.Stat(devicePath); err != nil {
+			return fmt.Errorf("PCI device %s not found: %w", device, err)
+		}
+		driver, err := os.Readlink(filepath.Join(devicePath, "driver"))
+		if err != nil || filepath.Base(driver) != "vfio-pci" {
+			return fmt.Errorf("PCI device %s must be bound to the vfio-pci driver to be passed to the VM", device)
+		}
+	}
+	return nil
+}
+
+// parseUSBID validates a USB device ID in the vendor:product format used by
+// lsusb, for example 046d:c52b
+func parseUSBID(id string) (string, string, error) {
+	matches := usbIDRegexp.FindStringSubmatch(id)
+	if matches == nil {
+		return "", "", fmt.Errorf("Invalid USB device ID '%s', expected format is vendor:product, for example 046d:c52b", id)
+	}
+	return strings.ToLower(matches[1]), strings.ToLower(matches[2]), nil
+}
+
+func readSysfsAttr(dir, name string) string {
+	value, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(value))
+}
+
+// findUSBDevice returns the bus and device numbers of the host USB device
+// with the given vendor:product ID
+func findUSBDevice(id string) (*libvirtxml.DomainAddressUSB, error) {
+	vendor, product, err := parseUSBID(id)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := os.ReadDir(sysBusUSB)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list USB devices: %w", err)
+	}
+	for _, device := range devices {
+		dir := filepath.Join(sysBusUSB, device.Name())
+		if readSysfsAttr(dir, "idVendor") != vendor || readSysfsAttr(dir, "idProduct") != product {
+			continue
+		}
+		bus, err := strconv.ParseUint(readSysfsAttr(dir, "busnum"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot find bus of USB device %s: %w", id, err)
+		}
+		dev, err := strconv.ParseUint(readSysfsAttr(dir, "devnum"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot find address of USB device %s: %w", id, err)
+		}
+		busNum, devNum := uint(bus), uint(dev)
+		return &libvirtxml.DomainAddressUSB{
+			Bus:    &busNum,
+			Device: &devNum,
+		}, nil
+	}
+	return nil, fmt.Errorf("USB device %s not found", id)
+}
+
+// usbHostdevs returns the USB devices passed to the VM. libvirtxml cannot
+// describe them by vendor and product ID, so they are referenced by their
+// current bus and device numbers. The VM must be recreated if the device is
+// plugged in another port.
+func (d *Driver) usbHostdevs() ([]libvirtxml.DomainHostdev, error) {
+	var hostdevs []libvirtxml.DomainHostdev
+	for _, id := range d.USBDevices {
+		address, err := findUSBDevice(id)
+		if err != nil {
+			return nil, err
+		}
+		hostdevs = append(hostdevs, libvirtxml.DomainHostdev{
+			Managed: "yes",
+			SubsysUSB: &libvirtxml.DomainHostdevSubsysUSB{
+				Source: &libvirtxml.DomainHostdevSubsysUSBSource{
+					Address: address,
+				},
+			},
+		})
+	}
+	return hostdevs, nil
+}
+
+// validateUSBDevices checks the USB devices passed to the VM are plugged in
+func (d *Driver) validateUSBDevices() error {
+	for _, id := range d.USBDevices {
+		if _, err := findUSBDevice(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
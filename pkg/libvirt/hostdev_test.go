@@ -0,0 +1,110 @@
+package libvirt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePCIAddress(t *testing.T) {
+	address, err := parsePCIAddress("0000:0a:1f.7")
+	assert.NoError(t, err)
+	assert.Equal(t, uint(0), *address.Domain)
+	assert.Equal(t, uint(0x0a), *address.Bus)
+	assert.Equal(t, uint(0x1f), *address.Slot)
+	assert.Equal(t, uint(7), *address.Function)
+
+	for _, invalid := range []string{"", "01:00.0", "0000:01:00.8", "0000:01:00", "pci_0000_01_00_0"} {
+		_, err := parsePCIAddress(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestPCIHostdevTemplating(t *testing.T) {
+	d := testDriver()
+	d.PCIDevices = []string{"0000:01:00.0", "0000:01:00.1"}
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<hostdev mode="subsystem" type="pci" managed="no">
+      <source>
+        <address domain="0x0000" bus="0x01" slot="0x00" function="0x0"></address>
+      </source>
+    </hostdev>
+    <hostdev mode="subsystem" type="pci" managed="no">
+      <source>
+        <address domain="0x0000" bus="0x01" slot="0x00" function="0x1"></address>
+      </source>
+    </hostdev>`)
+
+	d.PCIDevices = []string{"01:00.0"}
+	_, err = domainXML(d, "q35")
+	assert.Error(t, err)
+}
+
+func TestValidatePCIDevices(t *testing.T) {
+	orig := sysBusPCI
+	defer func() { sysBusPCI = orig }()
+	sysBusPCI = t.TempDir()
+
+	d := testDriver()
+	d.PCIDevices = []string{"0000:01:00.0"}
+	assert.ErrorContains(t, d.validatePCIDevices(), "not found")
+
+	device := filepath.Join(sysBusPCI, "0000:01:00.0")
+	assert.NoError(t, os.MkdirAll(device, 0700))
+	assert.ErrorContains(t, d.validatePCIDevices(), "vfio-pci")
+
+	assert.NoError(t, os.Symlink("../../../../bus/pci/drivers/nvidia", filepath.Join(device, "driver")))
+	assert.ErrorContains(t, d.validatePCIDevices(), "vfio-pci")
+
+	assert.NoError(t, os.Remove(filepath.Join(device, "driver")))
+	assert.NoError(t, os.Symlink("../../../../bus/pci/drivers/vfio-pci", filepath.Join(device, "driver")))
+	assert.NoError(t, d.validatePCIDevices())
+}
+
+func addUSBDevice(t *testing.T, name, vendor, product, bus, dev string) {
+	dir := filepath.Join(sysBusUSB, name)
+	assert.NoError(t, os.MkdirAll(dir, 0700))
+	for attr, value := range map[string]string{"idVendor": vendor, "idProduct": product, "busnum": bus, "devnum": dev} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, attr), []byte(value+"\n"), 0600))
+	}
+}
+
+func TestParseUSBID(t *testing.T) {
+	vendor, product, err := parseUSBID("046D:c52b")
+	assert.NoError(t, err)
+	assert.Equal(t, "046d", vendor)
+	assert.Equal(t, "c52b", product)
+
+	for _, invalid := range []string{"", "046d", "046d:c52b:1", "46d:c52b", "0x046d:0xc52b"} {
+		_, _, err := parseUSBID(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestUSBHostdevTemplating(t *testing.T) {
+	orig := sysBusUSB
+	defer func() { sysBusUSB = orig }()
+	sysBusUSB = t.TempDir()
+	addUSBDevice(t, "usb1", "1d6b", "0002", "1", "1")
+	addUSBDevice(t, "1-2", "046d", "c52b", "1", "4")
+	assert.NoError(t, os.MkdirAll(filepath.Join(sysBusUSB, "1-2:1.0"), 0700))
+
+	d := testDriver()
+	d.USBDevices = []string{"046d:c52b"}
+	assert.NoError(t, d.validateUSBDevices())
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<hostdev mode="subsystem" type="usb" managed="yes">
+      <source>
+        <address bus="1" device="4"></address>
+      </source>
+    </hostdev>`)
+
+	d.USBDevices = []string{"0781:5581"}
+	assert.ErrorContains(t, d.validateUSBDevices(), "not found")
+	_, err = domainXML(d, "q35")
+	assert.Error(t, err)
+}
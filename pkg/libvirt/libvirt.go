@@ -1,12 +1,17 @@
 package libvirt
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	libvirtdriver "github.com/crc-org/machine/drivers/libvirt"
@@ -17,11 +22,245 @@ import (
 	"libvirt.org/go/libvirtxml"
 )
 
+var (
+	// ErrConnectionFailed is returned when the connection to libvirt cannot
+	// be established, the libvirt error is wrapped and can be retrieved
+	// with errors.As to find out about the cause of the failure
+	ErrConnectionFailed = errors.New("Unable to connect to kvm driver, did you add yourself to the libvirtd group?")
+	// ErrNetworkNotFound is returned when the libvirt network used by the VM
+	// is not defined
+	ErrNetworkNotFound = errors.New("Use 'crc setup' to define the network")
+	// ErrAlreadyExists is returned when creating a VM which is already
+	// defined in libvirt
+	ErrAlreadyExists = errors.New("machine already exists")
+	// ErrDryRun is returned by Create in dry-run mode, after logging the
+	// domain definition, to tell nothing was created
+	ErrDryRun = errors.New("dry run, the VM was not created")
+	// ErrGuestAgentUnavailable is returned by the methods which need the
+	// QEMU guest agent when it is not running in the VM
+	ErrGuestAgentUnavailable = errors.New("guest agent not available")
+	// ErrKVMUnavailable is returned by PreCreateCheck when libvirt cannot
+	// run VMs with KVM acceleration on this host
+	ErrKVMUnavailable = errors.New("KVM acceleration unavailable")
+	// ErrRestartRequired is returned when a change cannot be applied to the
+	// running VM, it is stored in the domain definition and used after the
+	// next restart
+	ErrRestartRequired = errors.New("a restart of the VM is required")
+)
+
 type Driver struct {
 	*libvirtdriver.Driver
 
-	// Libvirt connection and state
+	// Driver specific configuration
+	Firmware   string
+	SecureBoot bool
+	TPM        bool
+	// CPUMode is the CPU model exposed to the VM: host-passthrough,
+	// host-model, or custom to use the libvirt CPU model named by CPUModel
+	CPUMode  string
+	CPUModel string
+	// Nested enables nested virtualization in the VM
+	Nested bool
+	// EmulatorPath is the QEMU binary running the VM, libvirt finds it when
+	// it is not set
+	EmulatorPath string
+	// ClockOffset is the initial time of the VM clock: utc or localtime
+	ClockOffset string
+	// RNG is the host source of the virtio RNG device: /dev/urandom,
+	// /dev/random, or none to remove the device
+	RNG string
+	// Watchdog is the action taken when the guest stops feeding its
+	// watchdog device: none, reset, poweroff or pause
+	Watchdog string
+	// PanicDevice is the model of the device used by the guest to report
+	// kernel panics, which trigger the OnCrash action: isa, pvpanic or
+	// hyperv. The VM has no panic device when it is empty.
+	PanicDevice string
+	// OnCrash, OnPoweroff and OnReboot are the actions taken when the guest
+	// crashes, powers off or reboots, libvirt defaults are used when unset
+	OnCrash    string
+	OnPoweroff string
+	OnReboot   string
+	// Graphics is the type of graphical console of the VM: none, vnc or spice
+	Graphics       string
+	GraphicsListen string
+	// VideoModel is the model of the video device of the VM: none, virtio,
+	// qxl or vga. libvirt picks it when unset, and headless VMs get none.
+	VideoModel string
+	// VideoVRAM is the video memory in KiB of qxl and vga video devices
+	VideoVRAM uint
+	// ExtraDiskSize is the size in GiB of an additional data disk, no
+	// additional disk is attached to the VM when it is 0
+	ExtraDiskSize uint64
+	// FailOnLowDiskSpace makes PreCreateCheck fail instead of warning when
+	// the storage pool directory does not have enough free space for the
+	// VM disks to grow to their full size
+	FailOnLowDiskSpace bool
+	// ExtraDiskShareable and ExtraDiskReadOnly allow the additional disk to
+	// be shared with other VMs, and make it read-only
+	ExtraDiskShareable bool
+	ExtraDiskReadOnly  bool
+	// MemoryHardLimit, MemorySoftLimit and MemorySwapHardLimit limit in MiB
+	// the host memory used by the VM, including the QEMU overhead. The VM
+	// is killed when it reaches the hard limit, so it must be well above
+	// the VM memory. A 0 value means no limit.
+	MemoryHardLimit     uint64
+	MemorySoftLimit     uint64
+	MemorySwapHardLimit uint64
+	// GrowGuestFilesystem makes the driver grow the root partition and
+	// filesystem of the VM through the guest agent when its disk is
+	// resized while it is running
+	GrowGuestFilesystem bool
+	// NUMANodes is the NUMA topology of the guest, which has a single node
+	// when it is empty
+	NUMANodes []NUMANode
+	// CPUShares is the relative CPU weight of the VM, CPUQuota the CPU time
+	// in microseconds each vCPU can use during CPUPeriod microseconds. A 0
+	// value keeps the host default, and a -1 quota means no limit.
+	CPUShares uint
+	CPUQuota  int64
+	CPUPeriod uint64
+	// MaxCPU is the vCPU count the running VM can be grown to without a
+	// restart, it defaults to the vCPU count so that hotplug is disabled.
+	// vCPU hotplug is also disabled when NUMANodes is set.
+	MaxCPU int
+	// IOThreads is the number of threads dedicated to the disk IO of the
+	// VM, the disks are handled by the QEMU main loop when it is 0
+	IOThreads uint
+	// DiskBus is the bus type of the VM disks: virtio, sata or scsi
+	DiskBus string
+	// RAMDisk places the VM disks on a tmpfs directory of the host for fast
+	// throwaway VMs, their content is lost when the host reboots. The disks
+	// are in a storage pool of their own, crc-ram-<machine name> unless
+	// StoragePool is set, which is removed together with the VM. It cannot be used together with a StoragePoolPath
+	// outside of /dev/shm.
+	RAMDisk bool
+	// Qcow2ClusterSize is the cluster size of the VM disk image, such as 64k
+	// or 2M, and Qcow2Preallocation its preallocation mode: off, metadata,
+	// falloc or full. qemu-img defaults are used when they are empty.
+	Qcow2ClusterSize   string
+	Qcow2Preallocation string
+	// DiskDiscard controls if discard/TRIM requests from the guest are
+	// passed to the disk image: ignore or unmap
+	DiskDiscard string
+	// MemoryStatsPeriod is the interval in seconds at which the guest
+	// reports its memory statistics
+	MemoryStatsPeriod int
+	// MaxMemory is the memory size in MiB the running VM can be grown to
+	// without a restart, it defaults to Memory. The VM only has a balloon
+	// device, needed to change its memory while it runs, when MaxMemory or
+	// MemoryStatsPeriod is set.
+	MaxMemory int
+	// StartTimeout is the maximum time in seconds to wait for the VM to get
+	// an IP address when it starts
+	StartTimeout int
+	// ConnectRetries is the number of times opening the libvirt connection
+	// is retried when it fails, a negative value disables retries
+	ConnectRetries int
+	// StoragePoolPath is the directory holding the VM disk images, it
+	// defaults to the machine directory in the store path. An existing
+	// storage pool must already use this directory.
+	StoragePoolPath string
+	// MachineDir is the directory of the VM in the store, it is set when
+	// the VM is renamed as it defaults to a directory named after the VM
+	MachineDir string
+	// Disk throughput limits, 0 means unlimited
+	DiskReadBytesSec  uint64
+	DiskWriteBytesSec uint64
+	DiskReadIopsSec   uint64
+	DiskWriteIopsSec  uint64
+	// Network bandwidth limits in KiB/s, 0 means unlimited
+	NetInboundKBps  int
+	NetOutboundKBps int
+	// NetworkMode is how the VM is connected: to the libvirt network named
+	// by Network, to the host bridge named by Network, directly to
+	// HostInterface using macvtap, or through user-mode networking
+	NetworkMode string
+	// PortForwards are the host ports forwarded to the VM in user network
+	// mode, in the proto:hostPort:guestPort format such as tcp:2222:22.
+	// One of them must forward to the SSH port of the VM.
+	PortForwards []string
+	// HostInterface is the physical network device of the host used in
+	// direct network mode
+	HostInterface string
+	// NICModel is the model of the VM network interface: virtio, e1000,
+	// e1000e or rtl8139
+	NICModel string
+
+	// PCIDevices are host PCI devices passed to the VM, in the
+	// 0000:01:00.0 format. They must be bound to the vfio-pci driver.
+	PCIDevices []string
+	// USBDevices are host USB devices passed to the VM, in the
+	// vendor:product format
+	USBDevices []string
+
+	// DryRun makes Create log the domain definition and return ErrDryRun
+	// without creating the disk images or defining the domain
+	DryRun bool
+
+	// KeepDisksOnRemove preserves the disk images of the VM when it is
+	// removed, for example for forensic purposes
+	KeepDisksOnRemove bool
+	// SSHPort is the port sshd listens on in the VM, DefaultSSHPort is used
+	// when it is 0
+	SSHPort int
+	// SSHKeyPath is the private key used to connect to the VM
+	SSHKeyPath string
+	// GenerateSSHKey creates a SSH key for the VM when SSHKeyPath is not set,
+	// the public key is passed to the VM through its ignition config
+	GenerateSSHKey bool
+
+	// WaitSSHOnStart makes Start wait until the SSH port of the VM accepts
+	// connections, for at most SSHTimeout seconds
+	WaitSSHOnStart bool
+	SSHTimeout     int
+
+	// GuestAgentTimeout is the time in seconds to wait for an answer of the
+	// QEMU guest agent when checking if it is ready
+	GuestAgentTimeout int
+
+	// IgnitionPath is an ignition config file passed to the VM through
+	// QEMU fw_cfg for its first boot
+	IgnitionPath string
+
+	// ISOPath is an ISO image attached to the VM as a read-only CD-ROM
+	ISOPath string
+	// BootOrder is the ordered list of devices the VM boots from: hd, cdrom
+	// or network. The VM boots from its disk when it is empty.
+	BootOrder []string
+
+	// ImportDisk is a disk image copied as is to be the VM disk, instead of
+	// creating an overlay on top of the bundle image
+	ImportDisk string
+
+	// MachineType is the QEMU machine type of the VM, such as q35 or pc. q35
+	// is used when it is unset and the hypervisor supports it.
+	MachineType string
+
+	// SMBIOSManufacturer, SMBIOSProduct, SMBIOSSerial and SMBIOSUUID are the
+	// system information the guest reads from its DMI tables
+	SMBIOSManufacturer string
+	SMBIOSProduct      string
+	SMBIOSSerial       string
+	SMBIOSUUID         string
+
+	// Kernel, Initrd and Cmdline are used for direct kernel boot, the disk
+	// bootloader is skipped when Kernel is set
+	Kernel  string
+	Initrd  string
+	Cmdline string
+
+	// ExternalSnapshots lists the overlay files created by external
+	// snapshots of the VM disk
+	ExternalSnapshots []string
+
+	// UUID of the libvirt domain, set when the VM is created
+	UUID string
+
+	// Libvirt connection and state, conn is guarded by connLock as Create
+	// uses it from two goroutines
 	conn     *libvirt.Connect
+	connLock sync.Mutex
 	vm       *libvirt.Domain
 	vmLoaded bool
 }
@@ -31,14 +270,40 @@ func (d *Driver) GetMachineName() string {
 }
 
 func (d *Driver) GetSSHHostname() (string, error) {
-	return d.GetIP()
+	ip, err := d.GetIP()
+	if err != nil || ip != "" {
+		return ip, err
+	}
+	// Fall back to IPv6 on IPv6-only networks
+	return d.GetIPv6()
+}
+
+func (d *Driver) GetSSHPort() (int, error) {
+	guestPort := d.SSHPort
+	if guestPort == 0 {
+		guestPort = DefaultSSHPort
+	}
+	if d.getNetworkMode() == NetworkModeUser {
+		return d.forwardedSSHPort(guestPort)
+	}
+	return guestPort, nil
+}
+
+func (d *Driver) GetSSHKeyPath() string {
+	return d.SSHKeyPath
 }
 
 func (d *Driver) GetSharedDirs() ([]drivers.SharedDir, error) {
-	if err := virtiofsSupported(d.conn); err != nil {
+	if _, err := d.getConn(); err != nil {
 		return nil, err
 	}
-	return d.SharedDirs, nil
+	sharedDirType := d.getSharedDirType()
+	sharedDirs := make([]drivers.SharedDir, 0, len(d.SharedDirs))
+	for _, sharedDir := range d.SharedDirs {
+		sharedDir.Type = sharedDirType
+		sharedDirs = append(sharedDirs, sharedDir)
+	}
+	return sharedDirs, nil
 }
 
 func (d *Driver) DriverName() string {
@@ -53,58 +318,163 @@ func convertMiBToKiB(sizeMb int) uint64 {
 	return uint64(sizeMb) * 1024
 }
 
-func (d *Driver) setMemory(memorySize int) error {
-	log.Debugf("Setting memory to %d MiB", memorySize)
+// memoryUpdateFlags returns the flags to use when changing the memory settings
+// of the domain, changes are also applied to the VM when it is running.
+func memoryUpdateFlags(running bool) libvirt.DomainMemoryModFlags {
+	if running {
+		return libvirt.DOMAIN_MEM_CONFIG | libvirt.DOMAIN_MEM_LIVE
+	}
+	return libvirt.DOMAIN_MEM_CONFIG
+}
+
+func checkLiveMemorySize(memorySize int, maxMemoryKiB uint64) error {
+	if convertMiBToKiB(memorySize) > maxMemoryKiB {
+		return fmt.Errorf("Cannot grow memory of the running VM to %d MiB, its maximum is %d MiB: %w", memorySize, maxMemoryKiB/1024, ErrRestartRequired)
+	}
+	return nil
+}
+
+// setMemory changes the memory size in the persistent domain configuration.
+// When live is true, the running VM is resized as well through its balloon
+// device, up to the maximum memory size it was started with.
+// ErrRestartRequired is returned when the running VM cannot be resized.
+func (d *Driver) setMemory(memorySize int, live bool) error {
+	log.Debugf("Setting memory to %d MiB (live: %t)", memorySize, live)
 	if err := d.validateVMRef(); err != nil {
 		return err
 	}
+
+	// The memory size can never be above the maximum, which must be raised
+	// first when growing and lowered last when shrinking
 	/* d.Memory is in MiB, SetMemoryFlags expects kiB */
-	err := d.vm.SetMemoryFlags(convertMiBToKiB(memorySize), libvirt.DOMAIN_MEM_MAXIMUM)
+	setMaximum := func() error {
+		return d.vm.SetMemoryFlags(convertMiBToKiB(d.getMaxMemory(memorySize)), libvirt.DOMAIN_MEM_CONFIG|libvirt.DOMAIN_MEM_MAXIMUM)
+	}
+	if memorySize > d.Memory {
+		if err := setMaximum(); err != nil {
+			return err
+		}
+	}
+	if err := d.vm.SetMemoryFlags(convertMiBToKiB(memorySize), libvirt.DOMAIN_MEM_CONFIG); err != nil {
+		return err
+	}
+	if memorySize < d.Memory {
+		if err := setMaximum(); err != nil {
+			return err
+		}
+	}
+
+	d.Memory = memorySize
+
+	if !live {
+		return nil
+	}
+	xmldoc, err := d.vm.GetXMLDesc(0)
 	if err != nil {
 		return err
 	}
-	err = d.vm.SetMemoryFlags(convertMiBToKiB(memorySize), libvirt.DOMAIN_MEM_CONFIG)
+	balloon, err := hasMemBalloonDevice(xmldoc)
 	if err != nil {
 		return err
 	}
+	if !balloon {
+		return fmt.Errorf("Cannot resize memory of the running VM, it has no balloon device: %w", ErrRestartRequired)
+	}
+	maxMemory, err := d.vm.GetMaxMemory()
+	if err != nil {
+		return err
+	}
+	if err := checkLiveMemorySize(memorySize, maxMemory); err != nil {
+		return err
+	}
+	return d.vm.SetMemoryFlags(convertMiBToKiB(memorySize), libvirt.DOMAIN_MEM_LIVE)
+}
 
-	d.Memory = memorySize
-
+func checkLiveVcpus(cpus uint, maxCPUs int32) error {
+	if int64(cpus) > int64(maxCPUs) {
+		return fmt.Errorf("Cannot grow vcpu count of the running VM to %d, its maximum is %d: %w", cpus, maxCPUs, ErrRestartRequired)
+	}
 	return nil
 }
 
-func (d *Driver) setVcpus(cpus uint) error {
-	log.Debugf("Setting vcpus to %d", cpus)
+// setVcpus changes the vcpu count in the persistent domain configuration.
+// When live is true, the new vcpus are also hotplugged into the running VM,
+// up to the vcpu maximum it was started with, ErrRestartRequired is returned
+// above it. Hot-unplug is not supported by most guests, so decreasing the vcpu
+// count of a running VM is rejected.
+func (d *Driver) setVcpus(cpus uint, live bool) error {
+	log.Debugf("Setting vcpus to %d (live: %t)", cpus, live)
 	if err := d.validateVMRef(); err != nil {
 		return err
 	}
-
-	err := d.vm.SetVcpusFlags(cpus, libvirt.DOMAIN_VCPU_CONFIG|libvirt.DOMAIN_VCPU_MAXIMUM)
-	if err != nil {
-		return err
+	if live && int(cpus) < d.CPU {
+		return fmt.Errorf("Cannot decrease vcpu count from %d to %d while the VM is running, stop it first", d.CPU, cpus)
 	}
-	err = d.vm.SetVcpusFlags(cpus, libvirt.DOMAIN_VCPU_CONFIG)
-	if err != nil {
+	// The vcpu count can never be above the maximum, which must be raised
+	// first when growing and lowered last when shrinking
+	setMaximum := func() error {
+		return d.vm.SetVcpusFlags(uint(d.getMaxCPU(int(cpus))), libvirt.DOMAIN_VCPU_CONFIG|libvirt.DOMAIN_VCPU_MAXIMUM)
+	}
+	if int(cpus) > d.CPU {
+		if err := setMaximum(); err != nil {
+			return err
+		}
+	}
+	if err := d.vm.SetVcpusFlags(cpus, libvirt.DOMAIN_VCPU_CONFIG); err != nil {
 		return err
 	}
+	if int(cpus) < d.CPU {
+		if err := setMaximum(); err != nil {
+			return err
+		}
+	}
 
 	d.CPU = int(cpus)
 
+	if live {
+		maxCPUs, err := d.vm.GetVcpusFlags(libvirt.DOMAIN_VCPU_LIVE | libvirt.DOMAIN_VCPU_MAXIMUM)
+		if err != nil {
+			return err
+		}
+		if err := checkLiveVcpus(cpus, maxCPUs); err != nil {
+			return err
+		}
+		if err := d.vm.SetVcpusFlags(cpus, libvirt.DOMAIN_VCPU_LIVE); err != nil {
+			return fmt.Errorf("Failed to hotplug vcpus, the new vcpu count will be used after a restart: %w", err)
+		}
+	}
+
 	return nil
 }
 
+func (d *Driver) isRunning() (bool, error) {
+	s, err := d.GetState()
+	if err != nil {
+		return false, err
+	}
+	return s == state.Running, nil
+}
+
 func (d *Driver) UpdateConfigRaw(rawConfig []byte) error {
-	var newDriver libvirtdriver.Driver
-	err := json.Unmarshal(rawConfig, &newDriver)
+	var newConfig Driver
+	err := json.Unmarshal(rawConfig, &newConfig)
 	if err != nil {
 		return err
 	}
+	if newConfig.Driver == nil {
+		return errors.New("Invalid driver configuration")
+	}
+	newDriver := *newConfig.Driver
 	// FIXME: not clear what the upper layers should do in case of partial errors?
 	// is it the drivers implementation responsibility to keep a consistent internal state,
 	// and should it return its (partial) new state when an error occurred?
 	if newDriver.Memory != d.Memory {
 		log.Debugf("Updating memory size to %d MiB", newDriver.Memory)
-		err := d.setMemory(newDriver.Memory)
+		running, err := d.isRunning()
+		if err != nil {
+			return err
+		}
+		err = d.setMemory(newDriver.Memory, running)
 		if err != nil {
 			log.Warnf("Failed to update memory: %v", err)
 			return err
@@ -112,7 +482,11 @@ func (d *Driver) UpdateConfigRaw(rawConfig []byte) error {
 	}
 	if newDriver.CPU != d.CPU {
 		log.Debugf("Updating vcpu count to %d", newDriver.CPU)
-		err := d.setVcpus(uint(newDriver.CPU))
+		running, err := d.isRunning()
+		if err != nil {
+			return err
+		}
+		err = d.setVcpus(uint(newDriver.CPU), running)
 		if err != nil {
 			log.Warnf("Failed to update CPU count: %v", err)
 			return err
@@ -124,7 +498,15 @@ func (d *Driver) UpdateConfigRaw(rawConfig []byte) error {
 		log.Debugf("failed to resize disk image: %v", err)
 		return err
 	}
+	// The key is not injected in the VM, its public part must already be
+	// authorized in the guest, for example through the ignition config
+	if newConfig.SSHKeyPath != d.SSHKeyPath {
+		log.Debugf("Updating SSH key path to %s", newConfig.SSHKeyPath)
+	}
+
 	*d.Driver = newDriver
+	d.SSHPort = newConfig.SSHPort
+	d.SSHKeyPath = newConfig.SSHKeyPath
 	return nil
 }
 
@@ -132,12 +514,94 @@ func (d *Driver) GetURL() (string, error) {
 	return "", nil
 }
 
+// connIsAlive checks if a libvirt connection can still be used, it can be
+// closed on the libvirtd side, for example when the daemon is restarted
+var connIsAlive = func(conn *libvirt.Connect) bool {
+	alive, err := conn.IsAlive()
+	return err == nil && alive
+}
+
+// dropStaleConn releases the cached libvirt connection if it is no longer
+// alive, together with the domain reference which is tied to it
+func (d *Driver) dropStaleConn() {
+	if d.conn == nil || connIsAlive(d.conn) {
+		return
+	}
+	log.Debugf("libvirt connection is no longer alive, reconnecting")
+	_ = d.Close()
+}
+
+// Close releases the libvirt connection and domain reference cached by the
+// driver, a new connection is opened when the driver is used again.
+// It is safe to call it multiple times.
+func (d *Driver) Close() error {
+	var err error
+	if d.vm != nil {
+		err = d.vm.Free()
+	}
+	d.vm = nil
+	d.vmLoaded = false
+	if d.conn != nil {
+		if _, closeErr := d.conn.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	d.conn = nil
+	return err
+}
+
+// newConnect opens a libvirt connection, it is a variable so that tests can
+// replace it
+var newConnect = libvirt.NewConnect
+
+// connectRetryDelay is the initial delay between two connection attempts
+var connectRetryDelay = 500 * time.Millisecond
+
+// isPermanentConnError returns true for connection errors which won't go away
+// by retrying, such as authentication or permission failures
+func isPermanentConnError(err error) bool {
+	var virErr libvirt.Error
+	if !errors.As(err, &virErr) {
+		return false
+	}
+	switch virErr.Code {
+	case libvirt.ERR_AUTH_FAILED, libvirt.ERR_AUTH_CANCELLED, libvirt.ERR_AUTH_UNAVAILABLE, libvirt.ERR_OPERATION_DENIED:
+		return true
+	}
+	return strings.Contains(virErr.Message, "Permission denied")
+}
+
+// getOpenConn returns the libvirt connection if it is already open, or nil,
+// without opening a new one
+func (d *Driver) getOpenConn() *libvirt.Connect {
+	d.connLock.Lock()
+	defer d.connLock.Unlock()
+	return d.conn
+}
+
 func (d *Driver) getConn() (*libvirt.Connect, error) {
+	d.connLock.Lock()
+	defer d.connLock.Unlock()
+	d.dropStaleConn()
 	if d.conn == nil {
-		conn, err := libvirt.NewConnect(connectionString)
+		var (
+			conn *libvirt.Connect
+			err  error
+		)
+		retries := d.getConnectRetries()
+		delay := connectRetryDelay
+		for attempt := 1; ; attempt++ {
+			conn, err = newConnect(connectionString)
+			if err == nil || attempt > retries || isPermanentConnError(err) {
+				break
+			}
+			log.Debugf("Failed to connect to libvirt (attempt %d/%d), retrying: %v", attempt, retries+1, err)
+			time.Sleep(delay)
+			delay = nextBackoff(delay, 2*time.Second)
+		}
 		if err != nil {
 			log.Errorf("Failed to connect to libvirt: %s", err)
-			return &libvirt.Connect{}, errors.New("Unable to connect to kvm driver, did you add yourself to the libvirtd group?")
+			return &libvirt.Connect{}, fmt.Errorf("%w (%w)", ErrConnectionFailed, err)
 		}
 		d.conn = conn
 	}
@@ -146,7 +610,15 @@ func (d *Driver) getConn() (*libvirt.Connect, error) {
 
 // Create, or verify the private network is properly configured
 func (d *Driver) validateNetwork() error {
-	if d.Network == "" {
+	if !d.hasNetwork() {
+		return nil
+	}
+	switch d.getNetworkMode() {
+	case NetworkModeBridge:
+		return validateBridge(d.Network)
+	case NetworkModeDirect:
+		return validateHostInterface(d.HostInterface)
+	case NetworkModeUser:
 		return nil
 	}
 	log.Debug("Validating network")
@@ -156,7 +628,7 @@ func (d *Driver) validateNetwork() error {
 	}
 	network, err := conn.LookupNetworkByName(d.Network)
 	if err != nil {
-		return fmt.Errorf("Use 'crc setup' to define the network, %+v", err)
+		return fmt.Errorf("%w, %w", ErrNetworkNotFound, err)
 	}
 	defer network.Free() // nolint:errcheck
 
@@ -187,22 +659,131 @@ func (d *Driver) validateNetwork() error {
 	return nil
 }
 
+func (d *Driver) validateFirmware() error {
+	switch d.getFirmware() {
+	case FirmwareBIOS:
+		if d.SecureBoot {
+			return fmt.Errorf("Secure boot requires '%s' firmware", FirmwareEFI)
+		}
+		return nil
+	case FirmwareEFI:
+		log.Debug("Checking UEFI firmware availability")
+		conn, err := d.getConn()
+		if err != nil {
+			return err
+		}
+		if err := efiSupported(conn); err != nil {
+			return fmt.Errorf("UEFI firmware is not available, make sure OVMF/edk2 is installed: %w", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("Invalid firmware '%s', valid values are '%s' and '%s'", d.Firmware, FirmwareBIOS, FirmwareEFI)
+	}
+}
+
 func (d *Driver) PreCreateCheck() error {
+	if err := d.validateConfig(); err != nil {
+		return err
+	}
+
 	conn, err := d.getConn()
 	if err != nil {
 		return err
 	}
 
-	// TODO We could look at conn.GetCapabilities()
-	// parse the XML, and look for kvm
+	kvm, err := d.HostSupportsKVM()
+	if err != nil {
+		return err
+	}
+	if !kvm {
+		return ErrKVMUnavailable
+	}
+	guest, err := getBestGuestFromCaps(conn)
+	if err != nil {
+		return err
+	}
+	if _, err := d.machineType(guest); err != nil {
+		return err
+	}
+
 	log.Debug("About to check libvirt version")
 
-	// TODO might want to check minimum version
-	_, err = conn.GetLibVersion()
+	version, err := conn.GetLibVersion()
 	if err != nil {
 		log.Warnf("Unable to get libvirt version")
 		return err
 	}
+	if err := checkLibvirtVersion(version, minLibvirtVersion); err != nil {
+		return err
+	}
+	err = d.validateFirmware()
+	if err != nil {
+		return err
+	}
+
+	if err := d.validateImageFormat(); err != nil {
+		return err
+	}
+	if err := d.validateImageSource(); err != nil {
+		return err
+	}
+
+	if err := d.validateIgnitionPath(); err != nil {
+		return err
+	}
+
+	if err := d.validateEmulatorPath(); err != nil {
+		return err
+	}
+
+	if err := d.validateKernel(); err != nil {
+		return err
+	}
+
+	if err := d.validateISOPath(); err != nil {
+		return err
+	}
+
+	if err := d.validatePCIDevices(); err != nil {
+		return err
+	}
+	if err := d.validateUSBDevices(); err != nil {
+		return err
+	}
+
+	if err := d.validateSharedDirs(); err != nil {
+		return err
+	}
+	if len(d.SharedDirs) != 0 && d.getSharedDirType() == SharedDirVirtiofs {
+		if err := virtiofsdAvailable(); err != nil {
+			return err
+		}
+	}
+
+	if d.Nested {
+		if err := nestedVirtSupported(); err != nil {
+			return err
+		}
+	}
+
+	if d.VSock {
+		if err := vsockSupported(); err != nil {
+			return err
+		}
+	}
+
+	if d.TPM {
+		if _, err := exec.LookPath("swtpm"); err != nil {
+			return fmt.Errorf("swtpm is required for TPM support, make sure it is installed: %w", err)
+		}
+	}
+
+	if d.getNetworkMode() == NetworkModeUser {
+		if _, err := exec.LookPath("passt"); err != nil {
+			return fmt.Errorf("passt is required for the user network mode, make sure it is installed: %w", err)
+		}
+	}
+
 	err = d.validateNetwork()
 	if err != nil {
 		return err
@@ -212,6 +793,31 @@ func (d *Driver) PreCreateCheck() error {
 	if err != nil {
 		return err
 	}
+	if err := d.checkStoragePoolPath(); err != nil {
+		return err
+	}
+
+	if err := d.checkDiskSpace(); err != nil {
+		return err
+	}
+
+	// The host may still be able to run the VM by swapping
+	resources, err := d.GetHostResources()
+	if err != nil {
+		if d.RAMDisk {
+			return fmt.Errorf("Cannot check free memory for the RAM disk: %w", err)
+		}
+		log.Debugf("Failed to get host resources: %v", err)
+	} else {
+		if d.RAMDisk {
+			if err := checkRAMDiskMemory(resources, d.Memory, d.DiskCapacity+d.ExtraDiskSize*1024*1024*1024); err != nil {
+				return err
+			}
+		}
+		for _, warning := range resourceWarnings(resources, d.Memory, d.CPU) {
+			log.Warn(warning)
+		}
+	}
 	// Others...?
 	return nil
 }
@@ -221,18 +827,22 @@ func (d *Driver) getDiskImageFilename() string {
 }
 
 func (d *Driver) getDiskImagePath() string {
-	return d.ResolveStorePath(fmt.Sprintf("%s.%s", d.MachineName, d.ImageFormat))
+	return filepath.Join(d.getStoragePoolPath(), d.getDiskImageFilename())
 }
 
 func (d *Driver) setupDiskImage() error {
 	diskPath := d.getDiskImagePath()
 
 	log.Debugf("Preparing %s for machine use", diskPath)
-	if d.ImageFormat != "qcow2" {
-		return fmt.Errorf("Unsupported VM image format: %s", d.ImageFormat)
+	if err := d.validateImageFormat(); err != nil {
+		return err
 	}
 
-	if err := createImage(d.ImageSourcePath, diskPath); err != nil {
+	if d.ImportDisk != "" {
+		if err := importImage(d.ImportDisk, diskPath); err != nil {
+			return err
+		}
+	} else if err := createImage(d.ImageSourcePath, diskPath, d.qcow2Options()); err != nil {
 		return err
 	}
 
@@ -243,9 +853,15 @@ func (d *Driver) setupDiskImage() error {
 		return err
 	}
 
+	if d.ExtraDiskSize != 0 {
+		if err := d.createExtraDisk(); err != nil {
+			return err
+		}
+	}
+
 	// Libvirt typically runs as a deprivileged service account and
 	// needs the execute bit set for directories that contain disks
-	for dir := d.ResolveStorePath("."); dir != "/"; dir = filepath.Dir(dir) {
+	for dir := d.getStoragePoolPath(); dir != "/"; dir = filepath.Dir(dir) {
 		log.Debugf("Verifying executable bit set on %s", dir)
 		info, err := os.Stat(dir)
 		if err != nil {
@@ -258,22 +874,85 @@ func (d *Driver) setupDiskImage() error {
 			if err := os.Chmod(dir, mode); err != nil {
 				return err
 			}
+			// Some filesystems ignore chmod, such as mounts with fixed
+			// permissions
+			if info, err := os.Stat(dir); err != nil || info.Mode()&0001 == 0 {
+				return fmt.Errorf("Cannot set the executable bit on %s, libvirt may not be able to access the VM disks", dir)
+			}
 		}
 	}
 
 	return nil
 }
 
-func getBestGuestFromCaps(conn *libvirt.Connect) (*libvirtxml.CapsGuest, error) {
+// minLibvirtVersion is checked by PreCreateCheck, it is a variable so that
+// tests can change it
+var minLibvirtVersion uint32 = MinLibvirtVersion
+
+func formatLibvirtVersion(version uint32) string {
+	return fmt.Sprintf("%d.%d.%d", version/1000000, version/1000%1000, version%1000)
+}
+
+func checkLibvirtVersion(version, minVersion uint32) error {
+	if version < minVersion {
+		return fmt.Errorf("libvirt >= %s required, found %s", formatLibvirtVersion(minVersion), formatLibvirtVersion(version))
+	}
+	return nil
+}
+
+func getCapabilities(conn *libvirt.Connect) (*libvirtxml.Caps, error) {
 	capsXML, err := conn.GetCapabilities()
 	if err != nil {
 		return nil, err
 	}
 	caps := &libvirtxml.Caps{}
-	err = caps.Unmarshal(capsXML)
-	if err != nil {
+	if err := caps.Unmarshal(capsXML); err != nil {
 		return nil, fmt.Errorf("Error parsing libvirt capabilities: %w", err)
 	}
+	return caps, nil
+}
+
+// GetHostCapabilities returns the capabilities of the host as reported by
+// libvirt
+func (d *Driver) GetHostCapabilities() (*libvirtxml.Caps, error) {
+	conn, err := d.getConn()
+	if err != nil {
+		return nil, err
+	}
+	return getCapabilities(conn)
+}
+
+// hasKVMDomain returns true when libvirt can run hvm guests of the host
+// architecture with the kvm domain type
+func hasKVMDomain(caps *libvirtxml.Caps) bool {
+	for _, guest := range caps.Guests {
+		if guest.OSType != "hvm" || guest.Arch.Name != caps.Host.CPU.Arch {
+			continue
+		}
+		for _, domain := range guest.Arch.Domains {
+			if domain.Type == "kvm" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HostSupportsKVM returns true when VMs can use KVM acceleration on this
+// host, it is not the case when /dev/kvm is missing or not accessible
+func (d *Driver) HostSupportsKVM() (bool, error) {
+	caps, err := d.GetHostCapabilities()
+	if err != nil {
+		return false, err
+	}
+	return hasKVMDomain(caps), nil
+}
+
+func getBestGuestFromCaps(conn *libvirt.Connect) (*libvirtxml.CapsGuest, error) {
+	caps, err := getCapabilities(conn)
+	if err != nil {
+		return nil, err
+	}
 
 	for _, guest := range caps.Guests {
 		if guest.OSType == "hvm" && guest.Arch.Name == caps.Host.CPU.Arch {
@@ -285,7 +964,23 @@ func getBestGuestFromCaps(conn *libvirt.Connect) (*libvirtxml.CapsGuest, error)
 	return nil, fmt.Errorf("Could not find a %s hypervisor with 'hvm' capabilities", caps.Host.CPU.Arch)
 }
 
-func getMachineType(guest *libvirtxml.CapsGuest) string {
+// machineType returns the machine type of the VM, MachineType if the
+// hypervisor supports it or the default one
+func (d *Driver) machineType(guest *libvirtxml.CapsGuest) (string, error) {
+	if d.MachineType == "" {
+		return defaultMachineType(guest), nil
+	}
+	for _, machine := range guest.Arch.Machines {
+		if machine.Name == d.MachineType || machine.Canonical == d.MachineType {
+			return d.MachineType, nil
+		}
+	}
+	return "", fmt.Errorf("Machine type %s is not supported by the hypervisor", d.MachineType)
+}
+
+// defaultMachineType returns q35 when it is available, or an empty string
+// to use the hypervisor default
+func defaultMachineType(guest *libvirtxml.CapsGuest) string {
 	for _, machine := range guest.Arch.Machines {
 		if machine.Name == "q35" || machine.Canonical == "q35" {
 			log.Debugf("Found q35 machine type")
@@ -297,23 +992,76 @@ func getMachineType(guest *libvirtxml.CapsGuest) string {
 	return ""
 }
 
+// runConcurrently prepares the disk image with setupDisk while getGuest
+// queries the host capabilities, the errors of both are returned
+func runConcurrently(setupDisk func() error, getGuest func() (*libvirtxml.CapsGuest, error)) (*libvirtxml.CapsGuest, error) {
+	var (
+		wg       sync.WaitGroup
+		guest    *libvirtxml.CapsGuest
+		guestErr error
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		guest, guestErr = getGuest()
+	}()
+	diskErr := setupDisk()
+	wg.Wait()
+	if diskErr != nil {
+		diskErr = fmt.Errorf("Failed to prepare VM disk image: %w", diskErr)
+	}
+	if guestErr != nil {
+		guestErr = fmt.Errorf("Failed to get host capabilities: %w", guestErr)
+	}
+	return guest, errors.Join(diskErr, guestErr)
+}
+
 func (d *Driver) Create() error {
-	err := d.setupDiskImage()
+	exists, err := d.Exists()
 	if err != nil {
 		return err
 	}
+	if exists {
+		return fmt.Errorf("%w: %s", ErrAlreadyExists, d.MachineName)
+	}
 
-	log.Debugf("Defining VM...")
-	conn, err := d.getConn()
-	if err != nil {
+	if d.DryRun {
+		xml, err := d.GetGeneratedXML()
+		if err != nil {
+			return err
+		}
+		log.Infof("Dry run, VM %s would be defined as:\n%s", d.MachineName, xml)
+		return ErrDryRun
+	}
+
+	if err := d.setupSSHKey(); err != nil {
 		return err
 	}
-	guest, err := getBestGuestFromCaps(conn)
+
+	// The host capabilities are queried while qemu-img prepares the disk
+	// image
+	var conn *libvirt.Connect
+	guest, err := runConcurrently(d.setupDiskImage, func() (*libvirtxml.CapsGuest, error) {
+		var err error
+		conn, err = d.getConn()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.GetLibVersion(); err != nil {
+			return nil, fmt.Errorf("Unable to get libvirt version: %w", err)
+		}
+		return getBestGuestFromCaps(conn)
+	})
 	if err != nil {
 		return err
 	}
 
-	xml, err := domainXML(d, getMachineType(guest))
+	log.Debugf("Defining VM...")
+	machineType, err := d.machineType(guest)
+	if err != nil {
+		return err
+	}
+	xml, err := domainXML(d, machineType)
 	if err != nil {
 		return err
 	}
@@ -326,31 +1074,119 @@ func (d *Driver) Create() error {
 	d.vm = vm
 	d.vmLoaded = true
 
+	uuid, err := vm.GetUUIDString()
+	if err != nil {
+		return err
+	}
+	d.UUID = uuid
+
 	_, err = d.resizeDiskImageIfNeeded(d.DiskCapacity)
 
 	return err
 }
 
-func createImage(src, dst string) error {
+// importImage copies the src image to dst, the copy has no backing file so
+// that it does not depend on other images
+func importImage(src, dst string) error {
+	qemuImg, err := qemuImgPath()
+	if err != nil {
+		return err
+	}
+	log.Debugf("Importing %s as %s", src, dst)
+	// #nosec G204
+	cmd := exec.Command(qemuImg, "convert", "-f", ImageFormatQcow2, "-O", ImageFormatQcow2, src, dst)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to import disk image %s: %v: %s", src, err, out)
+	}
+	return nil
+}
+
+func createImage(src, dst string, options []string) error {
 	start := time.Now()
 	defer func() {
 		log.Debugf("image creation took %s", time.Since(start).String())
 	}()
+	qemuImg, err := qemuImgPath()
+	if err != nil {
+		return err
+	}
 	// #nosec G204
-	cmd := exec.Command("qemu-img",
+	cmd := exec.Command(qemuImg,
 		"create",
 		"-f", "qcow2",
 		"-F", "qcow2",
-		"-o", fmt.Sprintf("backing_file=%s", src),
+		"-o", strings.Join(append([]string{fmt.Sprintf("backing_file=%s", src)}, options...), ","),
 		dst)
-	if err := cmd.Run(); err != nil {
-		log.Debugf("qemu-img create failed, falling back to copy: %v", err)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Warnf("qemu-img create failed, copying the disk image instead, its disk space won't be shared with the bundle image: %v: %s", err, out)
 		return copyFile(src, dst)
 	}
 	return nil
 }
 
+// validateImageSource checks the image used to create the VM disk, the
+// imported disk or the bundle image, can be used
+func (d *Driver) validateImageSource() error {
+	if d.ImportDisk != "" {
+		return d.validateImage(d.ImportDisk)
+	}
+	return d.validateImage(d.ImageSourcePath)
+}
+
+func (d *Driver) validateImage(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Cannot read VM image: %w", err)
+	}
+	_ = f.Close()
+
+	qemuImg, err := qemuImgPath()
+	if err != nil {
+		return err
+	}
+	// -U allows to inspect the image while other VMs are using it
+	// #nosec G204
+	out, err := exec.Command(qemuImg, "info", "-U", "--output=json", path).Output()
+	if err != nil {
+		return fmt.Errorf("Failed to get information about VM image %s: %w", path, err)
+	}
+	format, err := parseImageFormat(out)
+	if err != nil {
+		return err
+	}
+	if format != d.ImageFormat {
+		return fmt.Errorf("VM image %s has unsupported format %s, expected %s", path, format, d.ImageFormat)
+	}
+	return nil
+}
+
+// parseImageFormat returns the image format from the JSON output of
+// 'qemu-img info'
+func parseImageFormat(imageInfo []byte) (string, error) {
+	var info struct {
+		Format string `json:"format"`
+	}
+	if err := json.Unmarshal(imageInfo, &info); err != nil {
+		return "", fmt.Errorf("Failed to parse qemu-img output: %w", err)
+	}
+	return info.Format, nil
+}
+
+func qemuImgPath() (string, error) {
+	path, err := exec.LookPath("qemu-img")
+	if err != nil {
+		return "", fmt.Errorf("qemu-img is required to create the VM disk image, make sure it is installed: %w", err)
+	}
+	return path, nil
+}
+
 func (d *Driver) Start() error {
+	return d.StartContext(context.Background())
+}
+
+// StartContext starts the VM and waits for it to get an IP address, waiting
+// is aborted when ctx is cancelled
+func (d *Driver) StartContext(ctx context.Context) error {
 	log.Debugf("Starting VM %s", d.MachineName)
 	if err := d.validateVMRef(); err != nil {
 		return err
@@ -370,46 +1206,133 @@ func (d *Driver) Start() error {
 		d.DiskCapacity = diskCapacity
 	}
 
+	// libvirt restores the VM from its managed save image when there is one
+	restored, err := d.vm.HasManagedSaveImage(0)
+	if err != nil {
+		log.Debugf("Failed to check for a managed save image: %v", err)
+	}
 	if err := d.vm.Create(); err != nil {
 		log.Warnf("Failed to start: %s", err)
+		return d.diskAccessError(err)
+	}
+	if err := d.recordStartTime(); err != nil {
+		log.Warnf("Failed to record start time of VM %s: %v", d.MachineName, err)
+	}
+	if restored {
+		if err := d.SyncGuestTime(); err != nil {
+			log.Warnf("Guest clock may be wrong: %v", err)
+		}
+	}
+
+	if !d.hasNetwork() {
+		return nil
+	}
+
+	ipCtx, cancel := context.WithTimeout(ctx, d.getStartTimeout())
+	defer cancel()
+	if err := d.waitForIP(ipCtx); err != nil {
 		return err
 	}
 
-	if d.Network == "" {
+	if !d.WaitSSHOnStart {
+		return nil
+	}
+	sshCtx, cancel := context.WithTimeout(ctx, d.getSSHTimeout())
+	defer cancel()
+	return d.WaitForSSH(sshCtx)
+}
+
+// sleepContext waits for the given duration, or until ctx is done in which
+// case the context error is returned
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
 		return nil
 	}
+}
 
-	// They wont start immediately
-	time.Sleep(5 * time.Second)
+// nextBackoff doubles the wait delay between two polls, up to maxDelay
+func nextBackoff(delay, maxDelay time.Duration) time.Duration {
+	delay *= 2
+	if delay > maxDelay {
+		return maxDelay
+	}
+	return delay
+}
 
-	for i := 0; i < 60; i++ {
+// waitForIP polls the DHCP leases until the VM gets an IP address or the
+// context is done
+func (d *Driver) waitForIP(ctx context.Context) error {
+	delay := time.Second
+	for {
 		ip, err := d.GetIP()
 		if err != nil {
 			return fmt.Errorf("%v: getting ip during machine start", err)
 		}
-
-		if ip == "" {
-			log.Debugf("Waiting for machine to come up %d/%d", i, 60)
-			time.Sleep(3 * time.Second)
-			continue
-		}
-
 		if ip != "" {
 			log.Infof("Found IP for machine: %s", ip)
 			d.IPAddress = ip
-			break
+			return nil
 		}
-		log.Debugf("Waiting for the VM to come up... %d", i)
+
+		log.Debugf("Waiting for machine to come up, next check in %s", delay)
+		if err := sleepContext(ctx, delay); err != nil {
+			return fmt.Errorf("Unable to determine VM's IP address, did it fail to boot? (%w)", err)
+		}
+		delay = nextBackoff(delay, 5*time.Second)
 	}
+}
 
-	if d.IPAddress == "" {
-		log.Warnf("Unable to determine VM's IP address, did it fail to boot?")
-		return fmt.Errorf("Unable to determine VM's IP address, did it fail to boot?")
+// WaitForSSH waits until the SSH port of the VM accepts connections or the
+// context is done
+func (d *Driver) WaitForSSH(ctx context.Context) error {
+	ip, err := d.GetSSHHostname()
+	if err != nil {
+		return err
+	}
+	if ip == "" {
+		return fmt.Errorf("VM %s has no IP address", d.MachineName)
+	}
+	port, err := d.GetSSHPort()
+	if err != nil {
+		return err
+	}
+	return waitForTCP(ctx, net.JoinHostPort(ip, strconv.Itoa(port)))
+}
+
+// waitForTCP tries to connect to address until it succeeds or the context is
+// done
+func waitForTCP(ctx context.Context, address string) error {
+	var dialer net.Dialer
+	delay := time.Second
+	for {
+		dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		conn, err := dialer.DialContext(dialCtx, "tcp", address)
+		cancel()
+		if err == nil {
+			log.Debugf("SSH server of the VM is ready on %s", address)
+			return conn.Close()
+		}
+
+		log.Debugf("Waiting for SSH server on %s, next check in %s: %v", address, delay, err)
+		if err := sleepContext(ctx, delay); err != nil {
+			return fmt.Errorf("SSH server of the VM is not reachable on %s (%w)", address, err)
+		}
+		delay = nextBackoff(delay, 5*time.Second)
 	}
-	return nil
 }
 
 func (d *Driver) Stop() error {
+	return d.StopContext(context.Background())
+}
+
+// StopContext gracefully shuts down the VM and waits for it to be stopped,
+// waiting is aborted when ctx is cancelled
+func (d *Driver) StopContext(ctx context.Context) error {
 	log.Debugf("Stopping VM %s", d.MachineName)
 	if err := d.validateVMRef(); err != nil {
 		return err
@@ -425,15 +1348,13 @@ func (d *Driver) Stop() error {
 			log.Warnf("Failed to gracefully shutdown VM")
 			return err
 		}
-		for i := 0; i < 120; i++ {
-			time.Sleep(time.Second)
-			s, _ := d.GetState()
-			log.Debugf("VM state: %s", s)
-			if s == state.Stopped {
-				return nil
-			}
+		waitCtx, cancel := context.WithTimeout(ctx, 120*time.Second)
+		defer cancel()
+		err = d.WaitForState(waitCtx, state.Stopped)
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			return errors.New("VM Failed to gracefully shutdown, try the kill command")
 		}
-		return errors.New("VM Failed to gracefully shutdown, try the kill command")
+		return err
 	}
 	return nil
 }
@@ -441,14 +1362,56 @@ func (d *Driver) Stop() error {
 func (d *Driver) Remove() error {
 	log.Debugf("Removing VM %s", d.MachineName)
 	_ = d.validateVMRef()
-	if !d.vmLoaded {
+	if d.vmLoaded {
+		_ = d.vm.Destroy() // Ignore errors
+		// The swtpm state of the emulated TPM persists across restarts in
+		// /var/lib/libvirt/swtpm/<uuid>, libvirt deletes it on undefine as
+		// DOMAIN_UNDEFINE_KEEP_TPM is not passed.
+		// Undefine fails if the domain has snapshots unless their metadata
+		// is removed as well, internal snapshots are then deleted together
+		// with the disk image, and external ones below.
+		if err := d.vm.UndefineFlags(libvirt.DOMAIN_UNDEFINE_NVRAM | libvirt.DOMAIN_UNDEFINE_SNAPSHOTS_METADATA); err != nil {
+			return err
+		}
+		_ = d.vm.Free()
+		d.vm = nil
+		d.vmLoaded = false
+	}
+
+	if err := removeFile(d.GetConsoleLogPath()); err != nil {
+		return err
+	}
+	if d.KeepDisksOnRemove {
+		log.Infof("Keeping disk images of VM %s", d.MachineName)
 		return nil
 	}
-	// Note: If we switch to qcow disks instead of raw the user
-	//       could take a snapshot.  If you do, then Undefine
-	//       will fail unless we nuke the snapshots first
-	_ = d.vm.Destroy() // Ignore errors
-	return d.vm.UndefineFlags(libvirt.DOMAIN_UNDEFINE_NVRAM)
+	if err := d.removeVolume(d.getDiskImageFilename(), d.getDiskImagePath()); err != nil {
+		return err
+	}
+	if d.ExtraDiskSize != 0 {
+		if err := d.removeVolume(d.getExtraDiskFilename(), d.GetExtraDiskPath()); err != nil {
+			return err
+		}
+	}
+	for _, snapshot := range d.ExternalSnapshots {
+		if err := d.removeVolume(filepath.Base(snapshot), snapshot); err != nil {
+			return err
+		}
+	}
+	d.ExternalSnapshots = nil
+	// The RAM disk storage pool is dedicated to the VM
+	if d.RAMDisk {
+		return d.removeRAMDiskPool()
+	}
+	return nil
+}
+
+// removeFile removes path, it is not an error if it does not exist
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
 }
 
 func (d *Driver) Restart() error {
@@ -459,6 +1422,31 @@ func (d *Driver) Restart() error {
 	return d.Start()
 }
 
+// Reboot reboots the guest from the inside, which is faster than Restart
+// and keeps the QEMU process. The VM is stopped and started again when the
+// guest does not react to the reboot request.
+func (d *Driver) Reboot() error {
+	log.Debugf("Rebooting VM %s", d.MachineName)
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	if err := d.checkRunning(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rebootTimeout)
+	defer cancel()
+	rebooted, err := d.rebootGuest(ctx)
+	if err != nil {
+		log.Debugf("Failed to reboot VM %s: %v", d.MachineName, err)
+	}
+	if err == nil && rebooted {
+		log.Debugf("VM %s was rebooted by the guest", d.MachineName)
+		return nil
+	}
+	log.Infof("VM %s did not reboot, restarting it", d.MachineName)
+	return d.Restart()
+}
+
 func (d *Driver) Kill() error {
 	log.Debugf("Killing VM %s", d.MachineName)
 	if err := d.validateVMRef(); err != nil {
@@ -476,9 +1464,108 @@ func (d *Driver) GetState() (state.State, error) {
 	if err != nil {
 		return state.Error, err
 	}
+	return toMachineState(virState, reason)
+}
+
+// GetStateWithReason returns the machine state along with a description of
+// why libvirt put the VM in that state, e.g. to tell a clean shutdown from a
+// crash
+func (d *Driver) GetStateWithReason() (state.State, string, error) {
+	if err := d.validateVMRef(); err != nil {
+		return state.Error, "", err
+	}
+	virState, reason, err := d.vm.GetState()
+	if err != nil {
+		return state.Error, "", err
+	}
+	machineState, err := toMachineState(virState, reason)
+	return machineState, stateReason(virState, reason), err
+}
+
+// stateReason maps a libvirt reason code to a readable string, the meaning
+// of the code depends on the state it comes with
+func stateReason(virState libvirt.DomainState, reason int) string {
+	switch virState {
+	case libvirt.DOMAIN_RUNNING:
+		switch libvirt.DomainRunningReason(reason) {
+		case libvirt.DOMAIN_RUNNING_BOOTED:
+			return "booted"
+		case libvirt.DOMAIN_RUNNING_MIGRATED:
+			return "migrated"
+		case libvirt.DOMAIN_RUNNING_RESTORED:
+			return "restored"
+		case libvirt.DOMAIN_RUNNING_FROM_SNAPSHOT:
+			return "restored from snapshot"
+		case libvirt.DOMAIN_RUNNING_UNPAUSED:
+			return "unpaused"
+		case libvirt.DOMAIN_RUNNING_SAVE_CANCELED:
+			return "save canceled"
+		case libvirt.DOMAIN_RUNNING_WAKEUP:
+			return "woken up"
+		case libvirt.DOMAIN_RUNNING_CRASHED:
+			return "crashed"
+		}
+	case libvirt.DOMAIN_PAUSED:
+		switch libvirt.DomainPausedReason(reason) {
+		case libvirt.DOMAIN_PAUSED_USER:
+			return "paused by user"
+		case libvirt.DOMAIN_PAUSED_SAVE:
+			return "saving"
+		case libvirt.DOMAIN_PAUSED_DUMP:
+			return "dumping core"
+		case libvirt.DOMAIN_PAUSED_IOERROR:
+			return "disk I/O error"
+		case libvirt.DOMAIN_PAUSED_WATCHDOG:
+			return "watchdog fired"
+		case libvirt.DOMAIN_PAUSED_SNAPSHOT:
+			return "taking snapshot"
+		case libvirt.DOMAIN_PAUSED_SHUTTING_DOWN:
+			return "shutting down"
+		case libvirt.DOMAIN_PAUSED_STARTING_UP:
+			return "starting up"
+		case libvirt.DOMAIN_PAUSED_CRASHED:
+			return "crashed"
+		}
+	case libvirt.DOMAIN_SHUTDOWN:
+		if libvirt.DomainShutdownReason(reason) == libvirt.DOMAIN_SHUTDOWN_USER {
+			return "shutting down"
+		}
+	case libvirt.DOMAIN_SHUTOFF:
+		switch libvirt.DomainShutoffReason(reason) {
+		case libvirt.DOMAIN_SHUTOFF_SHUTDOWN:
+			return "shut down"
+		case libvirt.DOMAIN_SHUTOFF_DESTROYED:
+			return "destroyed"
+		case libvirt.DOMAIN_SHUTOFF_CRASHED:
+			return "crashed"
+		case libvirt.DOMAIN_SHUTOFF_SAVED:
+			return "saved"
+		case libvirt.DOMAIN_SHUTOFF_FAILED:
+			return "failed to start"
+		case libvirt.DOMAIN_SHUTOFF_MIGRATED:
+			return "migrated"
+		case libvirt.DOMAIN_SHUTOFF_FROM_SNAPSHOT:
+			return "reverted to snapshot"
+		case libvirt.DOMAIN_SHUTOFF_DAEMON:
+			return "stopped by libvirtd"
+		}
+	case libvirt.DOMAIN_CRASHED:
+		if libvirt.DomainCrashedReason(reason) == libvirt.DOMAIN_CRASHED_PANICKED {
+			return "guest panicked"
+		}
+		return "crashed"
+	}
+	return "unknown"
+}
+
+func toMachineState(virState libvirt.DomainState, reason int) (state.State, error) {
 	switch virState {
 	case libvirt.DOMAIN_RUNNING:
 		return state.Running, nil
+	case libvirt.DOMAIN_BLOCKED:
+		// The VM is alive, its vCPUs are waiting on a resource such as IO
+		log.Debugf("VM is blocked on a resource")
+		return state.Running, nil
 	case libvirt.DOMAIN_SHUTDOWN:
 		return state.Running, nil
 	case libvirt.DOMAIN_SHUTOFF:
@@ -498,7 +1585,7 @@ func (d *Driver) validateVMRef() error {
 		if err != nil {
 			return err
 		}
-		vm, err := conn.LookupDomainByName(d.MachineName)
+		vm, err := lookupDomain(conn, d.UUID, d.MachineName)
 		if err != nil {
 			log.Warnf("Failed to fetch machine")
 			return fmt.Errorf("Failed to fetch machine '%s'", d.MachineName)
@@ -509,8 +1596,68 @@ func (d *Driver) validateVMRef() error {
 	return nil
 }
 
-func (d *Driver) GetIP() (string, error) {
-	log.Debugf("GetIP called for %s", d.MachineName)
+// lookupDomain finds a domain using its UUID when it is known, and falls back
+// to its name
+func lookupDomain(conn *libvirt.Connect, uuid, name string) (*libvirt.Domain, error) {
+	if uuid != "" {
+		vm, err := conn.LookupDomainByUUIDString(uuid)
+		if err == nil {
+			return vm, nil
+		}
+		log.Debugf("Failed to find domain with UUID %s, looking it up by name: %v", uuid, err)
+	}
+	return conn.LookupDomainByName(name)
+}
+
+func isNoDomainError(err error) bool {
+	var virErr libvirt.Error
+	return errors.As(err, &virErr) && virErr.Code == libvirt.ERR_NO_DOMAIN
+}
+
+// Exists checks if the libvirt domain of the VM is defined
+func (d *Driver) Exists() (bool, error) {
+	conn, err := d.getConn()
+	if err != nil {
+		return false, err
+	}
+	vm, err := lookupDomain(conn, d.UUID, d.MachineName)
+	if err != nil {
+		if isNoDomainError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	_ = vm.Free()
+	return true, nil
+}
+
+// GetMachineUUID returns the UUID of the libvirt domain of the VM
+func (d *Driver) GetMachineUUID() (string, error) {
+	if err := d.validateVMRef(); err != nil {
+		return "", err
+	}
+	return d.vm.GetUUIDString()
+}
+
+// addressSources returns where libvirt should look for the VM IP addresses.
+// DHCP leases are only known for libvirt managed networks, otherwise the
+// guest agent is queried, then the host ARP table. With macvtap the host
+// can't reach the VM so only the guest agent knows its addresses.
+func (d *Driver) addressSources() []libvirt.DomainInterfaceAddressesSource {
+	switch d.getNetworkMode() {
+	case NetworkModeNetwork:
+		return []libvirt.DomainInterfaceAddressesSource{libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE}
+	case NetworkModeDirect:
+		return []libvirt.DomainInterfaceAddressesSource{libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT}
+	default:
+		return []libvirt.DomainInterfaceAddressesSource{
+			libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT,
+			libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_ARP,
+		}
+	}
+}
+
+func (d *Driver) lookupIP(addrType libvirt.IPAddrType) (string, error) {
 	s, err := d.GetState()
 	if err != nil {
 		return "", fmt.Errorf("%v : machine in unknown state", err)
@@ -518,23 +1665,82 @@ func (d *Driver) GetIP() (string, error) {
 	if s != state.Running {
 		return "", errors.New("host is not running")
 	}
-	ifaces, err := d.vm.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE)
-	if err != nil {
-		return "", err
+	if d.getNetworkMode() == NetworkModeUser {
+		// The VM is reached through the ports forwarded on the host
+		if addrType == libvirt.IP_ADDR_TYPE_IPV4 {
+			return "127.0.0.1", nil
+		}
+		return "", nil
 	}
-	for _, iface := range ifaces {
-		if iface.Hwaddr == macAddress {
-			for _, addr := range iface.Addrs {
-				if addr.Type == libvirt.IP_ADDR_TYPE_IPV4 { // ipv4
-					log.Debugf("IP address: %s", addr.Addr)
-					return addr.Addr, nil
-				}
+	sources := d.addressSources()
+	for i, source := range sources {
+		if source == libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT && !d.IsGuestAgentReady() {
+			// The agent is not running yet while the VM boots
+			log.Debugf("Guest agent is not ready, skipping it")
+			continue
+		}
+		ifaces, err := d.vm.ListAllInterfaceAddresses(source)
+		if err != nil {
+			if i == len(sources)-1 {
+				return "", err
 			}
+			log.Debugf("Failed to get VM addresses from source %d: %v", source, err)
+			continue
+		}
+		if ip := findIP(ifaces, addrType); ip != "" {
+			return ip, nil
 		}
 	}
 	return "", nil
 }
 
+// findIP returns the first address of the given type assigned to the VM
+// interface, IPv6 link-local addresses are skipped as they can't be used
+// to reach the VM without specifying the host interface
+func findIP(ifaces []libvirt.DomainInterface, addrType libvirt.IPAddrType) string {
+	for _, iface := range ifaces {
+		if iface.Hwaddr != macAddress {
+			continue
+		}
+		for _, addr := range iface.Addrs {
+			if addr.Type != addrType {
+				continue
+			}
+			if ip := net.ParseIP(addr.Addr); ip != nil && ip.IsLinkLocalUnicast() {
+				continue
+			}
+			return addr.Addr
+		}
+	}
+	return ""
+}
+
+func (d *Driver) GetIP() (string, error) {
+	log.Debugf("GetIP called for %s", d.MachineName)
+	ip, err := d.lookupIP(libvirt.IP_ADDR_TYPE_IPV4)
+	if err != nil {
+		return "", err
+	}
+	if ip != "" {
+		log.Debugf("IP address: %s", ip)
+	}
+	return ip, nil
+}
+
+// GetIPv6 returns the global IPv6 address of the VM, or an empty string if
+// it has none
+func (d *Driver) GetIPv6() (string, error) {
+	log.Debugf("GetIPv6 called for %s", d.MachineName)
+	ip, err := d.lookupIP(libvirt.IP_ADDR_TYPE_IPV6)
+	if err != nil {
+		return "", err
+	}
+	if ip != "" {
+		log.Debugf("IPv6 address: %s", ip)
+	}
+	return ip, nil
+}
+
 func NewDriver(hostName, storePath string) drivers.Driver {
 	return &Driver{
 		Driver: &libvirtdriver.Driver{
@@ -0,0 +1,410 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crc-org/machine/libmachine/state"
+	"github.com/stretchr/testify/assert"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+func TestMemoryUpdateFlags(t *testing.T) {
+	assert.Equal(t, libvirt.DOMAIN_MEM_CONFIG, memoryUpdateFlags(false))
+	assert.Equal(t, libvirt.DOMAIN_MEM_CONFIG|libvirt.DOMAIN_MEM_LIVE, memoryUpdateFlags(true))
+}
+
+func TestCheckLiveMemorySize(t *testing.T) {
+	assert.NoError(t, checkLiveMemorySize(4096, 8192*1024))
+	assert.NoError(t, checkLiveMemorySize(8192, 8192*1024))
+	assert.ErrorIs(t, checkLiveMemorySize(16384, 8192*1024), ErrRestartRequired)
+}
+
+func TestDropStaleConn(t *testing.T) {
+	defer func(isAlive func(*libvirt.Connect) bool) {
+		connIsAlive = isAlive
+	}(connIsAlive)
+
+	alive := true
+	connIsAlive = func(*libvirt.Connect) bool {
+		return alive
+	}
+
+	d := testDriver()
+	d.conn = &libvirt.Connect{}
+	d.vm = &libvirt.Domain{}
+	d.vmLoaded = true
+
+	d.dropStaleConn()
+	assert.NotNil(t, d.conn)
+	assert.NotNil(t, d.vm)
+	assert.True(t, d.vmLoaded)
+
+	alive = false
+	d.dropStaleConn()
+	assert.Nil(t, d.conn)
+	assert.Nil(t, d.vm)
+	assert.False(t, d.vmLoaded)
+}
+
+func TestGetConnRetries(t *testing.T) {
+	defer func(connect func(string) (*libvirt.Connect, error), delay time.Duration) {
+		newConnect = connect
+		connectRetryDelay = delay
+	}(newConnect, connectRetryDelay)
+	connectRetryDelay = time.Millisecond
+
+	var attempts int
+	failures := 2
+	connErr := libvirt.Error{Code: libvirt.ERR_SYSTEM_ERROR, Message: "Failed to connect socket: Connection refused"}
+	newConnect = func(string) (*libvirt.Connect, error) {
+		attempts++
+		if attempts <= failures {
+			return nil, connErr
+		}
+		return &libvirt.Connect{}, nil
+	}
+
+	d := testDriver()
+	_, err := d.getConn()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	failures = 5
+	d = testDriver()
+	_, err = d.getConn()
+	assert.ErrorIs(t, err, ErrConnectionFailed)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	d = testDriver()
+	d.ConnectRetries = -1
+	_, err = d.getConn()
+	assert.ErrorIs(t, err, ErrConnectionFailed)
+	assert.Equal(t, 1, attempts)
+
+	attempts = 0
+	connErr = libvirt.Error{Code: libvirt.ERR_SYSTEM_ERROR, Message: "Failed to connect socket: Permission denied"}
+	d = testDriver()
+	_, err = d.getConn()
+	assert.ErrorIs(t, err, ErrConnectionFailed)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestClose(t *testing.T) {
+	d := testDriver()
+	d.conn = &libvirt.Connect{}
+	d.vm = &libvirt.Domain{}
+	d.vmLoaded = true
+
+	_ = d.Close()
+	assert.Nil(t, d.conn)
+	assert.Nil(t, d.vm)
+	assert.False(t, d.vmLoaded)
+
+	assert.NoError(t, d.Close())
+}
+
+func TestNextBackoff(t *testing.T) {
+	assert.Equal(t, 2*time.Second, nextBackoff(time.Second, 5*time.Second))
+	assert.Equal(t, 4*time.Second, nextBackoff(2*time.Second, 5*time.Second))
+	assert.Equal(t, 5*time.Second, nextBackoff(4*time.Second, 5*time.Second))
+	assert.Equal(t, 5*time.Second, nextBackoff(5*time.Second, 5*time.Second))
+}
+
+func TestSleepContext(t *testing.T) {
+	assert.NoError(t, sleepContext(context.Background(), time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, sleepContext(ctx, time.Hour), context.Canceled)
+}
+
+func TestIsNoDomainError(t *testing.T) {
+	assert.True(t, isNoDomainError(libvirt.Error{Code: libvirt.ERR_NO_DOMAIN}))
+	assert.True(t, isNoDomainError(fmt.Errorf("lookup failed: %w", libvirt.Error{Code: libvirt.ERR_NO_DOMAIN})))
+	assert.False(t, isNoDomainError(libvirt.Error{Code: libvirt.ERR_OPERATION_FAILED}))
+	assert.False(t, isNoDomainError(errors.New("machine already exists")))
+}
+
+func TestRemoveFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "console.log")
+	assert.NoError(t, os.WriteFile(path, []byte("console"), 0600))
+
+	assert.NoError(t, removeFile(path))
+	assert.NoFileExists(t, path)
+	assert.NoError(t, removeFile(path))
+}
+
+func TestFindIP(t *testing.T) {
+	ifaces := []libvirt.DomainInterface{
+		{
+			Name:   "vnet1",
+			Hwaddr: "52:54:00:12:34:56",
+			Addrs: []libvirt.DomainIPAddress{
+				{Type: libvirt.IP_ADDR_TYPE_IPV4, Addr: "192.168.122.10", Prefix: 24},
+			},
+		},
+		{
+			Name:   "vnet0",
+			Hwaddr: macAddress,
+			Addrs: []libvirt.DomainIPAddress{
+				{Type: libvirt.IP_ADDR_TYPE_IPV6, Addr: "fe80::50fd:fcff:fe07:2182", Prefix: 64},
+				{Type: libvirt.IP_ADDR_TYPE_IPV6, Addr: "fd00:130::11", Prefix: 64},
+				{Type: libvirt.IP_ADDR_TYPE_IPV4, Addr: "192.168.130.11", Prefix: 24},
+			},
+		},
+	}
+	assert.Equal(t, "192.168.130.11", findIP(ifaces, libvirt.IP_ADDR_TYPE_IPV4))
+	assert.Equal(t, "fd00:130::11", findIP(ifaces, libvirt.IP_ADDR_TYPE_IPV6))
+
+	ifaces[1].Addrs = ifaces[1].Addrs[:1]
+	assert.Equal(t, "", findIP(ifaces, libvirt.IP_ADDR_TYPE_IPV4))
+	assert.Equal(t, "", findIP(ifaces, libvirt.IP_ADDR_TYPE_IPV6))
+}
+
+func TestAddressSources(t *testing.T) {
+	d := testDriver()
+	assert.Equal(t, []libvirt.DomainInterfaceAddressesSource{libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE}, d.addressSources())
+
+	d.NetworkMode = NetworkModeBridge
+	assert.Equal(t, []libvirt.DomainInterfaceAddressesSource{
+		libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT,
+		libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_ARP,
+	}, d.addressSources())
+
+	d.NetworkMode = NetworkModeDirect
+	assert.Equal(t, []libvirt.DomainInterfaceAddressesSource{libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT}, d.addressSources())
+}
+
+func TestGetSSHPort(t *testing.T) {
+	d := testDriver()
+	port, err := d.GetSSHPort()
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultSSHPort, port)
+
+	d.SSHPort = 2222
+	port, err = d.GetSSHPort()
+	assert.NoError(t, err)
+	assert.Equal(t, 2222, port)
+}
+
+func TestUpdateConfigRawSSHPort(t *testing.T) {
+	d := testDriver()
+	newDriver := testDriver()
+	newDriver.SSHPort = 2222
+	rawConfig, err := json.Marshal(newDriver)
+	assert.NoError(t, err)
+
+	assert.NoError(t, d.UpdateConfigRaw(rawConfig))
+	assert.Equal(t, 2222, d.SSHPort)
+
+	rawConfig, err = json.Marshal(d)
+	assert.NoError(t, err)
+	var restored Driver
+	assert.NoError(t, json.Unmarshal(rawConfig, &restored))
+	port, err := restored.GetSSHPort()
+	assert.NoError(t, err)
+	assert.Equal(t, 2222, port)
+}
+
+func TestUpdateConfigRawSSHKeyPath(t *testing.T) {
+	d := testDriver()
+	d.SSHKeyPath = "/home/user/.crc/id_ed25519"
+	newDriver := testDriver()
+	newDriver.SSHKeyPath = "/home/user/.crc/id_ed25519.new"
+	rawConfig, err := json.Marshal(newDriver)
+	assert.NoError(t, err)
+
+	assert.NoError(t, d.UpdateConfigRaw(rawConfig))
+	assert.Equal(t, "/home/user/.crc/id_ed25519.new", d.GetSSHKeyPath())
+}
+
+func TestWaitForTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := listener.Addr().String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, waitForTCP(ctx, address))
+
+	assert.NoError(t, listener.Close())
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, waitForTCP(ctx, address), context.DeadlineExceeded)
+}
+
+func TestCreateImageWithoutQemuImg(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("PATH", dir)
+	src := filepath.Join(dir, "src.qcow2")
+	dst := filepath.Join(dir, "dst.qcow2")
+	assert.NoError(t, os.WriteFile(src, []byte("image"), 0600))
+
+	assert.ErrorContains(t, createImage(src, dst, nil), "qemu-img is required")
+	assert.NoFileExists(t, dst)
+}
+
+func TestValidateImageSource(t *testing.T) {
+	d := testDriver()
+	d.ImageSourcePath = filepath.Join(t.TempDir(), "missing.qcow2")
+	assert.ErrorContains(t, d.validateImageSource(), "Cannot read VM image")
+
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("qemu-img is not installed")
+	}
+	d.ImageSourcePath = filepath.Join(t.TempDir(), "raw.img")
+	assert.NoError(t, os.WriteFile(d.ImageSourcePath, make([]byte, 4096), 0600))
+	assert.ErrorContains(t, d.validateImageSource(), "unsupported format raw")
+}
+
+func TestParseImageFormat(t *testing.T) {
+	format, err := parseImageFormat([]byte(`{"virtual-size": 33285996544, "filename": "crc.qcow2", "format": "qcow2"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "qcow2", format)
+
+	format, err = parseImageFormat([]byte(`{"virtual-size": 4096, "filename": "raw.img", "format": "raw"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "raw", format)
+
+	_, err = parseImageFormat([]byte("qemu-img: Could not open 'crc.qcow2'"))
+	assert.Error(t, err)
+}
+
+const testCapabilities = `<capabilities>
+  <host>
+    <cpu>
+      <arch>x86_64</arch>
+    </cpu>
+  </host>
+  <guest>
+    <os_type>hvm</os_type>
+    <arch name="i686">
+      <wordsize>32</wordsize>
+      <domain type="qemu"/>
+      <domain type="kvm"/>
+    </arch>
+  </guest>
+  <guest>
+    <os_type>hvm</os_type>
+    <arch name="x86_64">
+      <wordsize>64</wordsize>
+      <emulator>/usr/bin/qemu-system-x86_64</emulator>
+      <machine canonical="pc-q35-8.1" maxCpus="1024">q35</machine>
+      <domain type="qemu"/>
+      <domain type="kvm"/>
+    </arch>
+  </guest>
+</capabilities>`
+
+func TestHasKVMDomain(t *testing.T) {
+	caps := &libvirtxml.Caps{}
+	assert.NoError(t, caps.Unmarshal(testCapabilities))
+	assert.True(t, hasKVMDomain(caps))
+
+	caps.Guests[1].Arch.Domains = caps.Guests[1].Arch.Domains[:1]
+	assert.False(t, hasKVMDomain(caps))
+}
+
+func TestCheckLibvirtVersion(t *testing.T) {
+	assert.Equal(t, "9.10.2", formatLibvirtVersion(9010002))
+	assert.NoError(t, checkLibvirtVersion(9010002, MinLibvirtVersion))
+	assert.NoError(t, checkLibvirtVersion(MinLibvirtVersion, MinLibvirtVersion))
+	assert.EqualError(t, checkLibvirtVersion(5010000, 6000000), "libvirt >= 6.0.0 required, found 5.10.0")
+}
+
+func TestValidateImportDisk(t *testing.T) {
+	d := testDriver()
+	d.ImageSourcePath = filepath.Join(t.TempDir(), "bundle.qcow2")
+	assert.NoError(t, os.WriteFile(d.ImageSourcePath, []byte("image"), 0600))
+	d.ImportDisk = filepath.Join(t.TempDir(), "missing.qcow2")
+	assert.ErrorContains(t, d.validateImageSource(), "Cannot read VM image")
+}
+
+func TestMachineType(t *testing.T) {
+	caps := &libvirtxml.Caps{}
+	assert.NoError(t, caps.Unmarshal(testCapabilities))
+	guest := &caps.Guests[1]
+
+	d := testDriver()
+	machineType, err := d.machineType(guest)
+	assert.NoError(t, err)
+	assert.Equal(t, "q35", machineType)
+
+	d.MachineType = "pc-q35-8.1"
+	machineType, err = d.machineType(guest)
+	assert.NoError(t, err)
+	assert.Equal(t, "pc-q35-8.1", machineType)
+
+	d.MachineType = "pc"
+	_, err = d.machineType(guest)
+	assert.ErrorContains(t, err, "Machine type pc is not supported")
+}
+
+func TestStateReason(t *testing.T) {
+	assert.Equal(t, "shut down", stateReason(libvirt.DOMAIN_SHUTOFF, int(libvirt.DOMAIN_SHUTOFF_SHUTDOWN)))
+	assert.Equal(t, "crashed", stateReason(libvirt.DOMAIN_SHUTOFF, int(libvirt.DOMAIN_SHUTOFF_CRASHED)))
+	assert.Equal(t, "saved", stateReason(libvirt.DOMAIN_SHUTOFF, int(libvirt.DOMAIN_SHUTOFF_SAVED)))
+	assert.Equal(t, "booted", stateReason(libvirt.DOMAIN_RUNNING, int(libvirt.DOMAIN_RUNNING_BOOTED)))
+	assert.Equal(t, "disk I/O error", stateReason(libvirt.DOMAIN_PAUSED, int(libvirt.DOMAIN_PAUSED_IOERROR)))
+	assert.Equal(t, "guest panicked", stateReason(libvirt.DOMAIN_CRASHED, int(libvirt.DOMAIN_CRASHED_PANICKED)))
+	assert.Equal(t, "unknown", stateReason(libvirt.DOMAIN_NOSTATE, 0))
+}
+
+func TestToMachineState(t *testing.T) {
+	for _, tt := range []struct {
+		virState libvirt.DomainState
+		reason   int
+		expected state.State
+	}{
+		{libvirt.DOMAIN_RUNNING, int(libvirt.DOMAIN_RUNNING_BOOTED), state.Running},
+		{libvirt.DOMAIN_BLOCKED, 0, state.Running},
+		{libvirt.DOMAIN_SHUTDOWN, int(libvirt.DOMAIN_SHUTDOWN_USER), state.Running},
+		{libvirt.DOMAIN_SHUTOFF, int(libvirt.DOMAIN_SHUTOFF_SHUTDOWN), state.Stopped},
+		{libvirt.DOMAIN_PAUSED, int(libvirt.DOMAIN_PAUSED_STARTING_UP), state.Running},
+		{libvirt.DOMAIN_PAUSED, int(libvirt.DOMAIN_PAUSED_USER), state.Error},
+		{libvirt.DOMAIN_CRASHED, int(libvirt.DOMAIN_CRASHED_PANICKED), state.Error},
+	} {
+		s, err := toMachineState(tt.virState, tt.reason)
+		assert.Equal(t, tt.expected, s, tt.virState)
+		if tt.expected == state.Error {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func TestCheckLiveVcpus(t *testing.T) {
+	assert.NoError(t, checkLiveVcpus(4, 8))
+	assert.NoError(t, checkLiveVcpus(8, 8))
+	assert.ErrorIs(t, checkLiveVcpus(12, 8), ErrRestartRequired)
+}
+
+func TestRunConcurrently(t *testing.T) {
+	diskErr := errors.New("qemu-img failed")
+	capsErr := errors.New("no capabilities")
+	caps := &libvirtxml.CapsGuest{OSType: "hvm"}
+
+	guest, err := runConcurrently(func() error { return nil }, func() (*libvirtxml.CapsGuest, error) { return caps, nil })
+	assert.NoError(t, err)
+	assert.Equal(t, caps, guest)
+
+	_, err = runConcurrently(func() error { return diskErr }, func() (*libvirtxml.CapsGuest, error) { return caps, nil })
+	assert.ErrorIs(t, err, diskErr)
+
+	_, err = runConcurrently(func() error { return diskErr }, func() (*libvirtxml.CapsGuest, error) { return nil, capsErr })
+	assert.ErrorIs(t, err, diskErr)
+	assert.ErrorIs(t, err, capsErr)
+}
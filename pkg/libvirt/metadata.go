@@ -0,0 +1,84 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+// metadataNamespace is the XML namespace of the CRC metadata element of the
+// domain
+const metadataNamespace = "https://crc.dev/machine-driver-libvirt/metadata/1.0"
+
+// timeNow returns the current time, it is a variable so that tests can
+// replace it
+var timeNow = time.Now
+
+// CRCMetadata is stored in the domain definition to keep track of how the VM
+// was created
+type CRCMetadata struct {
+	XMLName       xml.Name  `xml:"https://crc.dev/machine-driver-libvirt/metadata/1.0 crc"`
+	DriverVersion string    `xml:"driverVersion"`
+	BundleName    string    `xml:"bundleName,omitempty"`
+	CreatedAt     time.Time `xml:"createdAt"`
+	// StartedAt is only set in the live definition of a running VM
+	StartedAt *time.Time `xml:"startedAt,omitempty"`
+}
+
+func (d *Driver) domainMetadata() (*libvirtxml.DomainMetadata, error) {
+	metadata, err := xml.Marshal(CRCMetadata{
+		DriverVersion: DriverVersion,
+		BundleName:    d.BundleName,
+		CreatedAt:     timeNow().UTC().Truncate(time.Second),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtxml.DomainMetadata{
+		XML: string(metadata),
+	}, nil
+}
+
+// GetMetadata returns the CRC metadata stored in the domain definition when
+// the VM was created
+func (d *Driver) GetMetadata() (*CRCMetadata, error) {
+	if err := d.validateVMRef(); err != nil {
+		return nil, err
+	}
+	xmldoc, err := d.vm.GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, metadataNamespace, libvirt.DOMAIN_AFFECT_CONFIG)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get metadata of VM %s: %w", d.MachineName, err)
+	}
+	return parseMetadata(xmldoc)
+}
+
+// recordStartTime stores the start time of the VM in the live metadata of the
+// domain, which is dropped when the VM stops
+func (d *Driver) recordStartTime() error {
+	xmldoc, err := d.vm.GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, metadataNamespace, libvirt.DOMAIN_AFFECT_LIVE)
+	if err != nil {
+		return err
+	}
+	metadata, err := parseMetadata(xmldoc)
+	if err != nil {
+		return err
+	}
+	startedAt := timeNow().UTC().Truncate(time.Second)
+	metadata.StartedAt = &startedAt
+	updated, err := xml.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return d.vm.SetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, string(updated), "crc", metadataNamespace, libvirt.DOMAIN_AFFECT_LIVE)
+}
+
+func parseMetadata(xmldoc string) (*CRCMetadata, error) {
+	var metadata CRCMetadata
+	if err := xml.Unmarshal([]byte(xmldoc), &metadata); err != nil {
+		return nil, fmt.Errorf("Failed to parse VM metadata: %w", err)
+	}
+	return &metadata, nil
+}
@@ -0,0 +1,37 @@
+package libvirt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	defer func(now func() time.Time) { timeNow = now }(timeNow)
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	timeNow = func() time.Time {
+		return createdAt
+	}
+
+	d := testDriver()
+	d.BundleName = "crc_libvirt_4.15.3_amd64.crcbundle"
+	domainMetadata, err := d.domainMetadata()
+	assert.NoError(t, err)
+
+	metadata, err := parseMetadata(domainMetadata.XML)
+	assert.NoError(t, err)
+	assert.Equal(t, DriverVersion, metadata.DriverVersion)
+	assert.Equal(t, "crc_libvirt_4.15.3_amd64.crcbundle", metadata.BundleName)
+	assert.True(t, createdAt.Equal(metadata.CreatedAt))
+
+	_, err = parseMetadata("<crc")
+	assert.Error(t, err)
+}
+
+func TestParseMetadataStartedAt(t *testing.T) {
+	metadata, err := parseMetadata(`<crc xmlns="https://crc.dev/machine-driver-libvirt/metadata/1.0"><driverVersion>0.13.9</driverVersion><createdAt>2024-01-02T03:04:05Z</createdAt><startedAt>2024-01-03T03:04:05Z</startedAt></crc>`)
+	assert.NoError(t, err)
+	assert.NotNil(t, metadata.StartedAt)
+	assert.Equal(t, time.Date(2024, 1, 3, 3, 4, 5, 0, time.UTC), *metadata.StartedAt)
+}
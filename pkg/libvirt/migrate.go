@@ -0,0 +1,70 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirt"
+)
+
+// migrationFlags returns the flags of a migration of the running VM, the
+// disks are copied to the destination when the storage is not shared
+func migrationFlags(live, sharedStorage bool) libvirt.DomainMigrateFlags {
+	flags := libvirt.MIGRATE_PEER2PEER | libvirt.MIGRATE_PERSIST_DEST | libvirt.MIGRATE_UNDEFINE_SOURCE
+	if live {
+		flags |= libvirt.MIGRATE_LIVE
+	}
+	if !sharedStorage {
+		flags |= libvirt.MIGRATE_NON_SHARED_DISK
+	}
+	return flags
+}
+
+func isMigrateUnsafeError(err error) bool {
+	var virErr libvirt.Error
+	if !errors.As(err, &virErr) {
+		return false
+	}
+	return virErr.Code == libvirt.ERR_MIGRATE_UNSAFE
+}
+
+// Migrate moves the running VM to the libvirt host with the given URI, such
+// as qemu+ssh://host/system. The VM keeps running during the migration when
+// live is true, it is paused otherwise. The disks are copied unless
+// sharedStorage is true, which the caller must only set when the destination
+// accesses the very same disk images, the destination would otherwise run the
+// VM from unrelated files at the same paths. The VM is undefined from this
+// host once it is migrated.
+func (d *Driver) Migrate(destURI string, live, sharedStorage bool) error {
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	if err := d.checkRunning(); err != nil {
+		return err
+	}
+	destConn, err := newConnect(destURI)
+	if err != nil {
+		return fmt.Errorf("Cannot connect to migration destination %s: %w", destURI, err)
+	}
+	defer destConn.Close() // nolint:errcheck
+
+	if !sharedStorage {
+		log.Infof("The VM disks will be copied to %s", destURI)
+	}
+	log.Debugf("Migrating VM %s to %s", d.MachineName, destURI)
+	vm, err := d.vm.Migrate(destConn, migrationFlags(live, sharedStorage), "", "", 0)
+	if err != nil {
+		if isMigrateUnsafeError(err) {
+			return fmt.Errorf("Cannot migrate VM %s to %s, its disks are not on storage shared with the destination and cannot be copied: %w", d.MachineName, destURI, err)
+		}
+		return fmt.Errorf("Failed to migrate VM %s to %s: %w", d.MachineName, destURI, err)
+	}
+	_ = vm.Free()
+
+	// The domain no longer exists on this host
+	_ = d.vm.Free()
+	d.vm = nil
+	d.vmLoaded = false
+	return nil
+}
@@ -0,0 +1,23 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"libvirt.org/go/libvirt"
+)
+
+func TestMigrationFlags(t *testing.T) {
+	flags := libvirt.MIGRATE_PEER2PEER | libvirt.MIGRATE_PERSIST_DEST | libvirt.MIGRATE_UNDEFINE_SOURCE
+	assert.Equal(t, flags|libvirt.MIGRATE_LIVE, migrationFlags(true, true))
+	assert.Equal(t, flags|libvirt.MIGRATE_NON_SHARED_DISK, migrationFlags(false, false))
+}
+
+func TestIsMigrateUnsafeError(t *testing.T) {
+	err := libvirt.Error{Code: libvirt.ERR_MIGRATE_UNSAFE}
+	assert.True(t, isMigrateUnsafeError(fmt.Errorf("migration failed: %w", err)))
+	assert.False(t, isMigrateUnsafeError(libvirt.Error{Code: libvirt.ERR_OPERATION_FAILED}))
+	assert.False(t, isMigrateUnsafeError(errors.New("migration failed")))
+}
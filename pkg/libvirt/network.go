@@ -0,0 +1,154 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirtxml"
+)
+
+// ReattachNetwork recovers the network connectivity of the VM when its
+// network was torn down while it was running. The network is restarted if
+// needed, then the network interface of the running VM is unplugged and
+// plugged again so that it is connected to the new network.
+func (d *Driver) ReattachNetwork() error {
+	log.Debugf("Reattaching network of VM %s", d.MachineName)
+	if !d.hasNetwork() {
+		return nil
+	}
+	if err := d.validateNetwork(); err != nil {
+		return fmt.Errorf("Failed to activate network %s: %w", d.Network, err)
+	}
+	running, err := d.isRunning()
+	if err != nil {
+		return err
+	}
+	if !running {
+		// The interface will be connected when the VM starts
+		return nil
+	}
+
+	iface := d.interfaceDevice()
+	xml, err := iface.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := d.vm.DetachDevice(xml); err != nil {
+		// The interface may already be gone, attaching it will tell
+		log.Debugf("Failed to detach network interface: %v", err)
+	}
+	if err := d.vm.AttachDevice(xml); err != nil {
+		return fmt.Errorf("Failed to reattach network interface: %w", err)
+	}
+	return nil
+}
+
+// portForward is a host port forwarded to a port of the VM in user network
+// mode
+type portForward struct {
+	proto     string
+	hostPort  uint
+	guestPort uint
+}
+
+func parsePort(port string) (uint, error) {
+	value, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || value == 0 {
+		return 0, fmt.Errorf("Invalid port '%s'", port)
+	}
+	return uint(value), nil
+}
+
+// parsePortForward parses a port forward in the proto:hostPort:guestPort
+// format, such as tcp:2222:22
+func parsePortForward(spec string) (*portForward, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Invalid port forward '%s', the format is proto:hostPort:guestPort", spec)
+	}
+	if err := validateChoice("port forward protocol", parts[0], []string{"tcp", "udp"}); err != nil {
+		return nil, err
+	}
+	hostPort, err := parsePort(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port forward '%s': %w", spec, err)
+	}
+	guestPort, err := parsePort(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port forward '%s': %w", spec, err)
+	}
+	return &portForward{
+		proto:     parts[0],
+		hostPort:  hostPort,
+		guestPort: guestPort,
+	}, nil
+}
+
+func (d *Driver) validatePortForwards() error {
+	if len(d.PortForwards) == 0 {
+		if d.getNetworkMode() == NetworkModeUser {
+			return errors.New("Port forwards are required in user network mode to reach the VM")
+		}
+		return nil
+	}
+	if d.getNetworkMode() != NetworkModeUser {
+		return fmt.Errorf("Port forwards can only be used in %s network mode", NetworkModeUser)
+	}
+	hostPorts := map[string]bool{}
+	for _, spec := range d.PortForwards {
+		forward, err := parsePortForward(spec)
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s:%d", forward.proto, forward.hostPort)
+		if hostPorts[key] {
+			return fmt.Errorf("Host port %s is forwarded more than once", key)
+		}
+		hostPorts[key] = true
+	}
+	guestPort := d.SSHPort
+	if guestPort == 0 {
+		guestPort = DefaultSSHPort
+	}
+	_, err := d.forwardedSSHPort(guestPort)
+	return err
+}
+
+// forwardedSSHPort returns the host port forwarded to the SSH port of the VM
+func (d *Driver) forwardedSSHPort(guestPort int) (int, error) {
+	for _, spec := range d.PortForwards {
+		forward, err := parsePortForward(spec)
+		if err != nil {
+			return 0, err
+		}
+		if forward.proto == "tcp" && forward.guestPort == uint(guestPort) {
+			return int(forward.hostPort), nil
+		}
+	}
+	return 0, fmt.Errorf("No host port is forwarded to the SSH port %d of the VM", guestPort)
+}
+
+// portForwards returns the port forwards of the network interface of the VM,
+// the configuration is validated beforehand so invalid entries are skipped
+func (d *Driver) portForwards() []libvirtxml.DomainInterfaceSourcePortForward {
+	var forwards []libvirtxml.DomainInterfaceSourcePortForward
+	for _, spec := range d.PortForwards {
+		forward, err := parsePortForward(spec)
+		if err != nil {
+			continue
+		}
+		forwards = append(forwards, libvirtxml.DomainInterfaceSourcePortForward{
+			Proto: forward.proto,
+			Ranges: []libvirtxml.DomainInterfaceSourcePortForwardRange{
+				{
+					Start: forward.hostPort,
+					To:    forward.guestPort,
+				},
+			},
+		})
+	}
+	return forwards
+}
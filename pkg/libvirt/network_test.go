@@ -0,0 +1,42 @@
+package libvirt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortForward(t *testing.T) {
+	forward, err := parsePortForward("tcp:2222:22")
+	assert.NoError(t, err)
+	assert.Equal(t, &portForward{proto: "tcp", hostPort: 2222, guestPort: 22}, forward)
+
+	for _, spec := range []string{"tcp:2222", "sctp:2222:22", "tcp:0:22", "tcp:2222:70000", "tcp:ssh:22"} {
+		_, err := parsePortForward(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestValidatePortForwards(t *testing.T) {
+	d := testDriver()
+	assert.NoError(t, d.validateConfig())
+
+	d.PortForwards = []string{"tcp:2222:22"}
+	assert.Error(t, d.validateConfig())
+
+	d.NetworkMode = NetworkModeUser
+	d.Network = ""
+	assert.NoError(t, d.validateConfig())
+	port, err := d.GetSSHPort()
+	assert.NoError(t, err)
+	assert.Equal(t, 2222, port)
+
+	d.PortForwards = []string{"tcp:2222:22", "tcp:2222:80"}
+	assert.Error(t, d.validateConfig())
+
+	d.PortForwards = []string{"tcp:8080:80"}
+	assert.Error(t, d.validateConfig())
+
+	d.PortForwards = nil
+	assert.Error(t, d.validateConfig())
+}
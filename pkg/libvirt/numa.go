@@ -0,0 +1,118 @@
+package libvirt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"libvirt.org/go/libvirtxml"
+)
+
+// NUMANode describes a NUMA node of the guest
+type NUMANode struct {
+	// CPUs is the list of vCPUs of the node, such as "0-3,6"
+	CPUs string
+	// Memory is the memory of the node in MiB
+	Memory uint
+	// HostNodes optionally pins the memory of the node to these host
+	// NUMA nodes, such as "0" or "0-1"
+	HostNodes string
+}
+
+// parseCPUSet returns the numbers in a comma separated list of numbers and
+// ranges, such as "0-3,6"
+func parseCPUSet(cpuset string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(cpuset, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CPU list '%s'", cpuset)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil || end < start {
+				return nil, fmt.Errorf("Invalid CPU list '%s'", cpuset)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// validateNUMA checks the NUMA nodes share all the memory and vCPUs of the VM,
+// each vCPU must belong to exactly one node
+func (d *Driver) validateNUMA() error {
+	if len(d.NUMANodes) == 0 {
+		return nil
+	}
+	var memory uint
+	assigned := map[int]bool{}
+	for i, node := range d.NUMANodes {
+		if node.Memory == 0 {
+			return fmt.Errorf("NUMA node %d has no memory", i)
+		}
+		memory += node.Memory
+		cpus, err := parseCPUSet(node.CPUs)
+		if err != nil {
+			return fmt.Errorf("NUMA node %d: %w", i, err)
+		}
+		for _, cpu := range cpus {
+			if cpu >= d.CPU {
+				return fmt.Errorf("NUMA node %d: vCPU %d does not exist, the VM has %d vCPUs", i, cpu, d.CPU)
+			}
+			if assigned[cpu] {
+				return fmt.Errorf("NUMA node %d: vCPU %d is already assigned to another node", i, cpu)
+			}
+			assigned[cpu] = true
+		}
+	}
+	if len(assigned) != d.CPU {
+		return fmt.Errorf("NUMA nodes only have %d of the %d vCPUs of the VM", len(assigned), d.CPU)
+	}
+	if memory != uint(d.Memory) {
+		return fmt.Errorf("NUMA nodes have %d MiB of memory, the VM has %d MiB", memory, d.Memory)
+	}
+	return nil
+}
+
+func (d *Driver) numa() *libvirtxml.DomainNuma {
+	if len(d.NUMANodes) == 0 {
+		return nil
+	}
+	numa := &libvirtxml.DomainNuma{}
+	for i, node := range d.NUMANodes {
+		id := uint(i)
+		numa.Cell = append(numa.Cell, libvirtxml.DomainCell{
+			ID:     &id,
+			CPUs:   node.CPUs,
+			Memory: node.Memory,
+			Unit:   "MiB",
+		})
+	}
+	return numa
+}
+
+// numaTune returns the pinning of the guest NUMA nodes to host NUMA nodes
+func (d *Driver) numaTune() *libvirtxml.DomainNUMATune {
+	var memNodes []libvirtxml.DomainNUMATuneMemNode
+	for i, node := range d.NUMANodes {
+		if node.HostNodes == "" {
+			continue
+		}
+		memNodes = append(memNodes, libvirtxml.DomainNUMATuneMemNode{
+			CellID:  uint(i),
+			Mode:    "strict",
+			Nodeset: node.HostNodes,
+		})
+	}
+	if len(memNodes) == 0 {
+		return nil
+	}
+	return &libvirtxml.DomainNUMATune{
+		MemNodes: memNodes,
+	}
+}
@@ -0,0 +1,44 @@
+package libvirt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCPUSet(t *testing.T) {
+	cpus, err := parseCPUSet("0-2,5")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2, 5}, cpus)
+
+	_, err = parseCPUSet("3-1")
+	assert.Error(t, err)
+	_, err = parseCPUSet("a")
+	assert.Error(t, err)
+	_, err = parseCPUSet("")
+	assert.Error(t, err)
+}
+
+func TestValidateNUMA(t *testing.T) {
+	d := testDriver()
+	assert.NoError(t, d.validateNUMA())
+
+	d.NUMANodes = []NUMANode{
+		{CPUs: "0-1", Memory: 2048, HostNodes: "0"},
+		{CPUs: "2,3", Memory: 2048},
+	}
+	assert.NoError(t, d.validateNUMA())
+
+	d.NUMANodes[1].Memory = 1024
+	assert.ErrorContains(t, d.validateNUMA(), "3072 MiB")
+
+	d.NUMANodes[1].Memory = 2048
+	d.NUMANodes[1].CPUs = "2"
+	assert.ErrorContains(t, d.validateNUMA(), "only have 3 of the 4 vCPUs")
+
+	d.NUMANodes[1].CPUs = "1-3"
+	assert.ErrorContains(t, d.validateNUMA(), "already assigned")
+
+	d.NUMANodes[1].CPUs = "2-4"
+	assert.ErrorContains(t, d.validateNUMA(), "vCPU 4 does not exist")
+}
@@ -0,0 +1,174 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/crc-org/machine/libmachine/state"
+	log "github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+// updateDomainPaths changes the source file of the disks and the log file of
+// the consoles of the domain XML using the old path to new path mapping of
+// paths
+func updateDomainPaths(xmldoc string, paths map[string]string) (string, error) {
+	var domain libvirtxml.Domain
+	if err := domain.Unmarshal(xmldoc); err != nil {
+		return "", err
+	}
+	if domain.Devices != nil {
+		for _, disk := range domain.Devices.Disks {
+			if disk.Source == nil || disk.Source.File == nil {
+				continue
+			}
+			if newPath, ok := paths[disk.Source.File.File]; ok {
+				disk.Source.File.File = newPath
+			}
+		}
+		for _, console := range domain.Devices.Consoles {
+			if console.Log == nil {
+				continue
+			}
+			if newPath, ok := paths[console.Log.File]; ok {
+				console.Log.File = newPath
+			}
+		}
+	}
+	return domain.Marshal()
+}
+
+// pinStorePaths sets the storage pool and the machine directory of the VM,
+// which default to values derived from its name, so that they do not change
+// with it. It returns a function restoring the previous configuration.
+func (d *Driver) pinStorePaths() func() {
+	pool, poolPath, machineDir := d.StoragePool, d.StoragePoolPath, d.MachineDir
+	d.StoragePool = d.getStoragePoolName()
+	d.StoragePoolPath = d.getStoragePoolPath()
+	d.MachineDir = d.ResolveStorePath(".")
+	return func() {
+		d.StoragePool = pool
+		d.StoragePoolPath = poolPath
+		d.MachineDir = machineDir
+	}
+}
+
+// Rename renames the stopped VM, its disk images and its console log. The
+// storage pool and the machine directory keep their current name, and the VM
+// must not have snapshots.
+func (d *Driver) Rename(newName string) error {
+	log.Debugf("Renaming VM %s to %s", d.MachineName, newName)
+	if newName == "" || newName == d.MachineName {
+		return fmt.Errorf("Invalid new name '%s' for VM %s", newName, d.MachineName)
+	}
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	s, err := d.GetState()
+	if err != nil {
+		return err
+	}
+	if s != state.Stopped {
+		return fmt.Errorf("VM %s must be stopped before it can be renamed", d.MachineName)
+	}
+	if len(d.ExternalSnapshots) != 0 {
+		return fmt.Errorf("VM %s has external snapshots, it cannot be renamed", d.MachineName)
+	}
+
+	conn, err := d.getConn()
+	if err != nil {
+		return err
+	}
+	vm, err := conn.LookupDomainByName(newName)
+	if err == nil {
+		_ = vm.Free()
+		return fmt.Errorf("%w: %s", ErrAlreadyExists, newName)
+	}
+	if !isNoDomainError(err) {
+		return err
+	}
+
+	restore := d.pinStorePaths()
+	paths := map[string]string{
+		d.getDiskImagePath(): filepath.Join(d.getStoragePoolPath(), fmt.Sprintf("%s.%s", newName, d.ImageFormat)),
+	}
+	if d.ExtraDiskSize != 0 {
+		paths[d.GetExtraDiskPath()] = filepath.Join(d.getStoragePoolPath(), fmt.Sprintf("%s-extra.qcow2", newName))
+	}
+	for _, newPath := range paths {
+		if _, err := os.Stat(newPath); err == nil {
+			restore()
+			return fmt.Errorf("Cannot rename VM %s, %s already exists", d.MachineName, newPath)
+		}
+	}
+	// The console log only exists once the VM was started
+	consoleLogPath := d.GetConsoleLogPath()
+	paths[consoleLogPath] = filepath.Join(filepath.Dir(consoleLogPath), fmt.Sprintf("%s-console.log", newName))
+
+	if err := d.vm.Rename(newName, 0); err != nil {
+		restore()
+		return fmt.Errorf("Failed to rename VM %s: %w", d.MachineName, err)
+	}
+	oldName := d.MachineName
+	d.MachineName = newName
+
+	renamed, err := d.renameFiles(conn, paths)
+	if err != nil {
+		// The pinned paths are still needed if the VM keeps its new name
+		if d.undoRename(oldName, renamed) {
+			restore()
+		}
+		return err
+	}
+
+	return d.refreshStoragePool()
+}
+
+// renameFiles moves the files of the VM using the old path to new path
+// mapping of paths and updates the VM definition accordingly. Missing files
+// are skipped. It returns the files which were moved, also on failure.
+func (d *Driver) renameFiles(conn *libvirt.Connect, paths map[string]string) (map[string]string, error) {
+	renamed := map[string]string{}
+	for oldPath, newPath := range paths {
+		if err := os.Rename(oldPath, newPath); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return renamed, fmt.Errorf("Failed to rename %s: %w", oldPath, err)
+		}
+		renamed[oldPath] = newPath
+	}
+	xmldoc, err := d.vm.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return renamed, err
+	}
+	xmldoc, err = updateDomainPaths(xmldoc, paths)
+	if err != nil {
+		return renamed, err
+	}
+	vm, err := conn.DomainDefineXML(xmldoc)
+	if err != nil {
+		return renamed, fmt.Errorf("Failed to update VM definition: %w", err)
+	}
+	_ = vm.Free()
+	return renamed, nil
+}
+
+// undoRename moves the renamed files back and gives the VM its old name after
+// a failed rename, it returns false when the VM could not be renamed back
+func (d *Driver) undoRename(oldName string, renamed map[string]string) bool {
+	for oldPath, newPath := range renamed {
+		if err := os.Rename(newPath, oldPath); err != nil {
+			log.Warnf("Failed to move %s back to %s: %v", newPath, oldPath, err)
+		}
+	}
+	if err := d.vm.Rename(oldName, 0); err != nil {
+		log.Warnf("Failed to rename VM %s back to %s: %v", d.MachineName, oldName, err)
+		return false
+	}
+	d.MachineName = oldName
+	return true
+}
@@ -0,0 +1,53 @@
+package libvirt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateDomainPaths(t *testing.T) {
+	d := testDriver()
+	d.ExtraDiskSize = 10
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+
+	xml, err = updateDomainPaths(xml, map[string]string{
+		"machines/domain/domain.test":        "machines/domain/renamed.test",
+		"machines/domain/domain-extra.qcow2": "machines/domain/renamed-extra.qcow2",
+		"machines/domain/domain-console.log": "machines/domain/renamed-console.log",
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<source file="machines/domain/renamed.test"></source>`)
+	assert.Contains(t, xml, `<source file="machines/domain/renamed-extra.qcow2"></source>`)
+	assert.NotContains(t, xml, `<source file="machines/domain/domain.test"></source>`)
+	assert.Contains(t, xml, `<log file="machines/domain/renamed-console.log" append="off"></log>`)
+}
+
+func TestRenameInvalidName(t *testing.T) {
+	d := testDriver()
+	assert.Error(t, d.Rename(""))
+	assert.Error(t, d.Rename(d.MachineName))
+}
+
+func TestPinStorePaths(t *testing.T) {
+	d := testDriver()
+	d.StorePath = "/store"
+	restore := d.pinStorePaths()
+	d.MachineName = "renamed"
+	assert.Equal(t, "/store/machines/domain/renamed-console.log", d.GetConsoleLogPath())
+	assert.Equal(t, "/store/machines/domain/renamed.test", d.getDiskImagePath())
+	assert.Equal(t, "domain", d.getStoragePoolName())
+
+	d.MachineName = "domain"
+	restore()
+	assert.Empty(t, d.StoragePool)
+	assert.Empty(t, d.StoragePoolPath)
+	assert.Empty(t, d.MachineDir)
+
+	// The pinned RAM disk directory is still valid
+	d.RAMDisk = true
+	_ = d.pinStorePaths()
+	assert.Equal(t, "/dev/shm/crc-domain", d.StoragePoolPath)
+	assert.NoError(t, d.validateConfig())
+}
@@ -0,0 +1,33 @@
+package libvirt
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// selinuxEnforcePath tells if SELinux is enforcing, it is a variable so that
+// tests can change it
+var selinuxEnforcePath = "/sys/fs/selinux/enforce"
+
+func selinuxEnforcing() bool {
+	data, err := os.ReadFile(selinuxEnforcePath)
+	return err == nil && strings.TrimSpace(string(data)) == "1"
+}
+
+// diskAccessError adds a hint to the error of a VM start which failed because
+// QEMU was denied access to a file, usually the VM disks. The file
+// permissions are fixed when the disks are created, so the SELinux labels
+// are the next likely cause.
+func (d *Driver) diskAccessError(err error) error {
+	if !strings.Contains(err.Error(), "Permission denied") {
+		return err
+	}
+	dir := d.getStoragePoolPath()
+	hint := fmt.Sprintf("check the libvirt service user can access %s and its parent directories", dir)
+	if selinuxEnforcing() {
+		hint = fmt.Sprintf("SELinux is enforcing, label the directory with 'semanage fcontext -a -t virt_image_t \"%s(/.*)?\"' and 'restorecon -R %s', "+
+			"or enable the virt_use_nfs or virt_use_samba boolean with setsebool when it is on a network filesystem", dir, dir)
+	}
+	return fmt.Errorf("QEMU cannot access the files of VM %s, %s: %w", d.MachineName, hint, err)
+}
@@ -0,0 +1,31 @@
+package libvirt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskAccessError(t *testing.T) {
+	orig := selinuxEnforcePath
+	defer func() { selinuxEnforcePath = orig }()
+	selinuxEnforcePath = filepath.Join(t.TempDir(), "enforce")
+
+	d := testDriver()
+	d.StoragePoolPath = "/mnt/crc"
+	err := errors.New("internal error: process exited while connecting to monitor")
+	assert.Equal(t, err, d.diskAccessError(err))
+
+	err = errors.New("Could not open '/mnt/crc/domain.qcow2': Permission denied")
+	accessErr := d.diskAccessError(err)
+	assert.ErrorIs(t, accessErr, err)
+	assert.ErrorContains(t, accessErr, "can access /mnt/crc")
+
+	assert.NoError(t, os.WriteFile(selinuxEnforcePath, []byte("1\n"), 0600))
+	accessErr = d.diskAccessError(err)
+	assert.ErrorIs(t, accessErr, err)
+	assert.ErrorContains(t, accessErr, "virt_image_t")
+}
@@ -0,0 +1,54 @@
+package libvirt
+
+import (
+	"fmt"
+	"regexp"
+
+	"libvirt.org/go/libvirtxml"
+)
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+func (d *Driver) validateSMBIOS() error {
+	if d.SMBIOSUUID != "" && !uuidRegexp.MatchString(d.SMBIOSUUID) {
+		return fmt.Errorf("Invalid SMBIOS UUID '%s'", d.SMBIOSUUID)
+	}
+	if d.SMBIOSUUID != "" && d.UUID != "" && d.UUID != d.SMBIOSUUID {
+		return fmt.Errorf("SMBIOS UUID '%s' does not match the UUID of the existing domain '%s'", d.SMBIOSUUID, d.UUID)
+	}
+	return nil
+}
+
+// smbiosSysInfo returns the system information exposed to the guest through
+// SMBIOS, the domain must use the sysinfo SMBIOS mode for the guest to see it
+func (d *Driver) smbiosSysInfo() libvirtxml.DomainSysInfo {
+	entries := []libvirtxml.DomainSysInfoEntry{
+		{
+			Name:  "manufacturer",
+			Value: d.getSMBIOSManufacturer(),
+		},
+		{
+			Name:  "product",
+			Value: d.getSMBIOSProduct(),
+		},
+	}
+	if d.SMBIOSSerial != "" {
+		entries = append(entries, libvirtxml.DomainSysInfoEntry{
+			Name:  "serial",
+			Value: d.SMBIOSSerial,
+		})
+	}
+	if d.SMBIOSUUID != "" {
+		entries = append(entries, libvirtxml.DomainSysInfoEntry{
+			Name:  "uuid",
+			Value: d.SMBIOSUUID,
+		})
+	}
+	return libvirtxml.DomainSysInfo{
+		SMBIOS: &libvirtxml.DomainSysInfoSMBIOS{
+			System: &libvirtxml.DomainSysInfoSystem{
+				Entry: entries,
+			},
+		},
+	}
+}
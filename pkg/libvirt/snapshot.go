@@ -0,0 +1,95 @@
+package libvirt
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+// validateSnapshotName checks the snapshot name can be used in the file name
+// of an external snapshot
+func validateSnapshotName(name string) error {
+	if name == "" || strings.ContainsRune(name, '/') {
+		return fmt.Errorf("Invalid snapshot name '%s'", name)
+	}
+	return nil
+}
+
+func (d *Driver) getSnapshotPath(name string) string {
+	return filepath.Join(d.getStoragePoolPath(), fmt.Sprintf("%s-%s.qcow2", d.MachineName, name))
+}
+
+func (d *Driver) snapshotXML(name string, external bool) (string, error) {
+	snapshot := libvirtxml.DomainSnapshot{
+		Name: name,
+	}
+	if external {
+		snapshot.Disks = &libvirtxml.DomainSnapshotDisks{
+			Disks: []libvirtxml.DomainSnapshotDisk{
+				{
+					Name:     d.getDiskTarget(),
+					Snapshot: "external",
+					Driver: &libvirtxml.DomainDiskDriver{
+						Type: "qcow2",
+					},
+					Source: &libvirtxml.DomainDiskSource{
+						File: &libvirtxml.DomainDiskSourceFile{
+							File: d.getSnapshotPath(name),
+						},
+					},
+				},
+			},
+		}
+		if d.ExtraDiskSize != 0 {
+			snapshot.Disks.Disks = append(snapshot.Disks.Disks, libvirtxml.DomainSnapshotDisk{
+				Name:     d.getExtraDiskTarget(),
+				Snapshot: "no",
+			})
+		}
+	}
+	return snapshot.Marshal()
+}
+
+// CreateSnapshot takes a snapshot of the VM disk.
+//
+// Internal snapshots are stored in the qcow2 disk image of the VM, they are
+// easy to revert to and are removed together with the disk image, but libvirt
+// does not support them for VMs using UEFI firmware.
+// External snapshots only cover the disk, they freeze the current disk image
+// and add a new qcow2 overlay on top of it, which becomes the VM disk and the
+// volume resized or reported by the disk functions of the driver. This
+// lengthens the backing chain which starts with the bundle image used to
+// create the VM. The overlay files are kept in the storage pool directory and
+// are deleted when the VM is removed.
+func (d *Driver) CreateSnapshot(name string, external bool) error {
+	log.Debugf("Creating snapshot %s of VM %s (external: %t)", name, d.MachineName, external)
+	if err := validateSnapshotName(name); err != nil {
+		return err
+	}
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	xml, err := d.snapshotXML(name, external)
+	if err != nil {
+		return err
+	}
+	var flags libvirt.DomainSnapshotCreateFlags
+	if external {
+		flags = libvirt.DOMAIN_SNAPSHOT_CREATE_DISK_ONLY | libvirt.DOMAIN_SNAPSHOT_CREATE_ATOMIC
+	}
+	snapshot, err := d.vm.CreateSnapshotXML(xml, flags)
+	if err != nil {
+		return fmt.Errorf("Failed to create snapshot %s: %w", name, err)
+	}
+	defer snapshot.Free() // nolint:errcheck
+
+	if external {
+		d.ExternalSnapshots = append(d.ExternalSnapshots, d.getSnapshotPath(name))
+	}
+
+	return nil
+}
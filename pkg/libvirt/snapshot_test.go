@@ -0,0 +1,47 @@
+package libvirt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInternalSnapshotXML(t *testing.T) {
+	xml, err := testDriver().snapshotXML("snap1", false)
+	assert.NoError(t, err)
+	assert.Equal(t, `<domainsnapshot>
+  <name>snap1</name>
+</domainsnapshot>`, xml)
+}
+
+func TestExternalSnapshotXML(t *testing.T) {
+	d := testDriver()
+	d.ExtraDiskSize = 10
+	xml, err := d.snapshotXML("snap1", true)
+	assert.NoError(t, err)
+	assert.Equal(t, `<domainsnapshot>
+  <name>snap1</name>
+  <disks>
+    <disk type="file" name="vda" snapshot="external">
+      <driver type="qcow2"></driver>
+      <source file="machines/domain/domain-snap1.qcow2"></source>
+    </disk>
+    <disk name="vdb" snapshot="no"></disk>
+  </disks>
+</domainsnapshot>`, xml)
+}
+
+func TestValidateSnapshotName(t *testing.T) {
+	assert.NoError(t, validateSnapshotName("snap1"))
+	assert.Error(t, validateSnapshotName(""))
+	assert.Error(t, validateSnapshotName("../../x"))
+	assert.Error(t, validateSnapshotName("a/b"))
+}
+
+func TestActiveDiskFilename(t *testing.T) {
+	d := testDriver()
+	assert.Equal(t, "domain.test", d.getActiveDiskFilename())
+
+	d.ExternalSnapshots = []string{d.getSnapshotPath("snap1"), d.getSnapshotPath("snap2")}
+	assert.Equal(t, "domain-snap2.qcow2", d.getActiveDiskFilename())
+}
@@ -0,0 +1,172 @@
+package libvirt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sshKeyType = "ssh-ed25519"
+	// ignitionUser is the user whose authorized keys are set in the
+	// ignition config
+	ignitionUser = "core"
+)
+
+// appendSSHString appends data using the SSH wire format for strings, its
+// length as a big endian uint32 followed by its content
+func appendSSHString(buf []byte, data []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+	return append(buf, data...)
+}
+
+func sshPublicKeyBlob(pub ed25519.PublicKey) []byte {
+	blob := appendSSHString(nil, []byte(sshKeyType))
+	return appendSSHString(blob, pub)
+}
+
+// marshalAuthorizedKey returns the public key in the authorized_keys format
+func marshalAuthorizedKey(pub ed25519.PublicKey) string {
+	return fmt.Sprintf("%s %s", sshKeyType, base64.StdEncoding.EncodeToString(sshPublicKeyBlob(pub)))
+}
+
+// marshalPrivateKey returns the unencrypted private key in the OpenSSH
+// format, as described in the PROTOCOL.key file of OpenSSH
+func marshalPrivateKey(priv ed25519.PrivateKey, comment string) ([]byte, error) {
+	var check [4]byte
+	if _, err := rand.Read(check[:]); err != nil {
+		return nil, err
+	}
+	private := append([]byte{}, check[:]...)
+	private = append(private, check[:]...)
+	private = appendSSHString(private, []byte(sshKeyType))
+	private = appendSSHString(private, priv.Public().(ed25519.PublicKey))
+	private = appendSSHString(private, priv)
+	private = appendSSHString(private, []byte(comment))
+	for i := byte(1); len(private)%8 != 0; i++ {
+		private = append(private, i)
+	}
+
+	key := []byte("openssh-key-v1\x00")
+	key = appendSSHString(key, []byte("none"))
+	key = appendSSHString(key, []byte("none"))
+	key = appendSSHString(key, nil)
+	key = binary.BigEndian.AppendUint32(key, 1)
+	key = appendSSHString(key, sshPublicKeyBlob(priv.Public().(ed25519.PublicKey)))
+	key = appendSSHString(key, private)
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: key,
+	}), nil
+}
+
+// generateSSHKey creates an ed25519 key pair in the machine directory and
+// returns the path to the private key and the public key in the
+// authorized_keys format
+func (d *Driver) generateSSHKey() (string, string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	privateKey, err := marshalPrivateKey(priv, d.MachineName)
+	if err != nil {
+		return "", "", err
+	}
+	authorizedKey := marshalAuthorizedKey(pub)
+
+	keyPath := d.ResolveStorePath("id_ed25519")
+	if err := os.WriteFile(keyPath, privateKey, 0600); err != nil {
+		return "", "", fmt.Errorf("Failed to write SSH private key: %w", err)
+	}
+	if err := os.WriteFile(keyPath+".pub", []byte(authorizedKey+"\n"), 0644); err != nil {
+		return "", "", fmt.Errorf("Failed to write SSH public key: %w", err)
+	}
+	return keyPath, authorizedKey, nil
+}
+
+// addIgnitionSSHKey adds the public key to the authorized keys of the core
+// user in the ignition config, a minimal config is created if there is none
+func addIgnitionSSHKey(ignition []byte, authorizedKey string) ([]byte, error) {
+	config := map[string]interface{}{
+		"ignition": map[string]interface{}{
+			"version": "3.2.0",
+		},
+	}
+	if len(ignition) != 0 {
+		if err := json.Unmarshal(ignition, &config); err != nil {
+			return nil, fmt.Errorf("Failed to parse ignition config: %w", err)
+		}
+	}
+
+	passwd, _ := config["passwd"].(map[string]interface{})
+	if passwd == nil {
+		passwd = map[string]interface{}{}
+		config["passwd"] = passwd
+	}
+	users, _ := passwd["users"].([]interface{})
+	var user map[string]interface{}
+	for _, u := range users {
+		if u, ok := u.(map[string]interface{}); ok && u["name"] == ignitionUser {
+			user = u
+			break
+		}
+	}
+	if user == nil {
+		user = map[string]interface{}{"name": ignitionUser}
+		users = append(users, user)
+		passwd["users"] = users
+	}
+	keys, _ := user["sshAuthorizedKeys"].([]interface{})
+	user["sshAuthorizedKeys"] = append(keys, authorizedKey)
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(config); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// setupSSHKey generates the SSH key of the VM when requested and no key was
+// provided. The public key is added to a copy of the ignition config stored
+// in the machine directory, which is then passed to the VM instead.
+func (d *Driver) setupSSHKey() error {
+	if !d.GenerateSSHKey || d.SSHKeyPath != "" {
+		return nil
+	}
+	log.Debugf("Generating SSH key for VM %s", d.MachineName)
+	keyPath, authorizedKey, err := d.generateSSHKey()
+	if err != nil {
+		return err
+	}
+
+	var ignition []byte
+	if d.IgnitionPath != "" {
+		ignition, err = os.ReadFile(d.IgnitionPath)
+		if err != nil {
+			return fmt.Errorf("Cannot read ignition config file: %w", err)
+		}
+	}
+	ignition, err = addIgnitionSSHKey(ignition, authorizedKey)
+	if err != nil {
+		return err
+	}
+	ignitionPath := d.ResolveStorePath("config.ign")
+	if err := os.WriteFile(ignitionPath, ignition, 0600); err != nil {
+		return fmt.Errorf("Failed to write ignition config: %w", err)
+	}
+
+	d.SSHKeyPath = keyPath
+	d.IgnitionPath = ignitionPath
+	return nil
+}
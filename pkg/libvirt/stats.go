@@ -0,0 +1,518 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/crc-org/machine/libmachine/state"
+	log "github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+// VMInfo holds the resource usage and state of the VM
+type VMInfo struct {
+	// MaxMem is the maximum memory of the VM in KiB
+	MaxMem uint64
+	// Memory is the memory currently used by the VM in KiB
+	Memory    uint64
+	NrVirtCPU uint
+	// CPUTime is the CPU time used by the VM in nanoseconds
+	CPUTime uint64
+	State   state.State
+}
+
+// GetVMInfo returns the current resource usage and state of the VM
+func (d *Driver) GetVMInfo() (*VMInfo, error) {
+	if err := d.validateVMRef(); err != nil {
+		return nil, err
+	}
+	info, err := d.vm.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	// The reason is not part of the domain info, GetState must be used
+	// to know if a paused VM is starting up
+	vmState, err := toMachineState(info.State, 0)
+	if err != nil {
+		vmState = state.Error
+	}
+
+	return &VMInfo{
+		MaxMem:    info.MaxMem,
+		Memory:    info.Memory,
+		NrVirtCPU: info.NrVirtCpu,
+		CPUTime:   info.CpuTime,
+		State:     vmState,
+	}, nil
+}
+
+// DriverState is a summary of the configuration and current state of the VM
+type DriverState struct {
+	MachineName string
+	UUID        string
+	State       state.State
+	// IP is empty when the VM is not running or has no IP address yet
+	IP      string
+	Network string
+	// Memory is the configured memory of the VM in MiB
+	Memory int
+	// ActualMemory is the memory currently used by the VM in KiB
+	ActualMemory uint64
+	CPU          uint
+	// DiskCapacity is the virtual size of the VM disk in bytes
+	DiskCapacity uint64
+	// DiskAllocation is the space used by the VM disk on the host in bytes
+	DiskAllocation uint64
+}
+
+// GetDriverState returns the configuration and current state of the VM in a
+// single call
+func (d *Driver) GetDriverState() (*DriverState, error) {
+	info, err := d.GetVMInfo()
+	if err != nil {
+		return nil, err
+	}
+	volInfo, err := d.getVolInfo()
+	if err != nil {
+		return nil, err
+	}
+	driverState := &DriverState{
+		MachineName:    d.MachineName,
+		UUID:           d.UUID,
+		State:          info.State,
+		Network:        d.Network,
+		Memory:         d.Memory,
+		ActualMemory:   info.Memory,
+		CPU:            info.NrVirtCPU,
+		DiskCapacity:   volInfo.Capacity,
+		DiskAllocation: volInfo.Allocation,
+	}
+	if info.State == state.Running {
+		ip, err := d.GetIP()
+		if err != nil {
+			log.Debugf("Failed to get IP of VM %s: %v", d.MachineName, err)
+		}
+		driverState.IP = ip
+	}
+	return driverState, nil
+}
+
+// HostResources holds the memory and CPUs of the host
+type HostResources struct {
+	// TotalMemory and FreeMemory are the memory of the host in MiB
+	TotalMemory uint64
+	FreeMemory  uint64
+	CPUs        uint
+}
+
+// GetHostResources returns the memory and CPUs of the host
+func (d *Driver) GetHostResources() (*HostResources, error) {
+	conn, err := d.getConn()
+	if err != nil {
+		return nil, err
+	}
+	nodeInfo, err := conn.GetNodeInfo()
+	if err != nil {
+		return nil, err
+	}
+	freeMemory, err := conn.GetFreeMemory()
+	if err != nil {
+		return nil, err
+	}
+	return &HostResources{
+		TotalMemory: nodeInfo.Memory / 1024,
+		FreeMemory:  freeMemory / 1024 / 1024,
+		CPUs:        nodeInfo.Cpus,
+	}, nil
+}
+
+// resourceWarnings returns the reasons why the host may not be able to run a
+// VM with the given memory in MiB and CPUs
+func resourceWarnings(resources *HostResources, memory, cpus int) []string {
+	var warnings []string
+	if uint64(memory) > resources.FreeMemory {
+		warnings = append(warnings, fmt.Sprintf("VM memory %d MiB is more than the free host memory %d MiB", memory, resources.FreeMemory))
+	}
+	if uint(cpus) > resources.CPUs {
+		warnings = append(warnings, fmt.Sprintf("VM CPU count %d is more than the host CPU count %d", cpus, resources.CPUs))
+	}
+	return warnings
+}
+
+// checkRAMDiskMemory checks the host has enough free memory, in MiB, for a VM
+// with the given memory and RAM disk size in bytes
+func checkRAMDiskMemory(resources *HostResources, memory int, diskSize uint64) error {
+	required := uint64(memory) + diskSize/1024/1024
+	if required > resources.FreeMemory {
+		return fmt.Errorf("The VM and its RAM disk need %d MiB of memory, only %d MiB are free", required, resources.FreeMemory)
+	}
+	return nil
+}
+
+// checkRunning returns an error if the VM is not running, statistics are
+// only available for running VMs
+func (d *Driver) checkRunning() error {
+	running, err := d.isRunning()
+	if err != nil {
+		return err
+	}
+	if !running {
+		return fmt.Errorf("VM %s is not running", d.MachineName)
+	}
+	return nil
+}
+
+// memoryStatNames are the names used by 'virsh dommemstat' for the memory
+// statistics of the VM
+var memoryStatNames = map[libvirt.DomainMemoryStatTags]string{
+	libvirt.DOMAIN_MEMORY_STAT_SWAP_IN:         "swap_in",
+	libvirt.DOMAIN_MEMORY_STAT_SWAP_OUT:        "swap_out",
+	libvirt.DOMAIN_MEMORY_STAT_MAJOR_FAULT:     "major_fault",
+	libvirt.DOMAIN_MEMORY_STAT_MINOR_FAULT:     "minor_fault",
+	libvirt.DOMAIN_MEMORY_STAT_UNUSED:          "unused",
+	libvirt.DOMAIN_MEMORY_STAT_AVAILABLE:       "available",
+	libvirt.DOMAIN_MEMORY_STAT_ACTUAL_BALLOON:  "actual",
+	libvirt.DOMAIN_MEMORY_STAT_RSS:             "rss",
+	libvirt.DOMAIN_MEMORY_STAT_USABLE:          "usable",
+	libvirt.DOMAIN_MEMORY_STAT_LAST_UPDATE:     "last_update",
+	libvirt.DOMAIN_MEMORY_STAT_DISK_CACHES:     "disk_caches",
+	libvirt.DOMAIN_MEMORY_STAT_HUGETLB_PGALLOC: "hugetlb_pgalloc",
+	libvirt.DOMAIN_MEMORY_STAT_HUGETLB_PGFAIL:  "hugetlb_pgfail",
+}
+
+func memoryStatsToMap(stats []libvirt.DomainMemoryStat) map[string]uint64 {
+	statsMap := make(map[string]uint64, len(stats))
+	for _, stat := range stats {
+		name, ok := memoryStatNames[libvirt.DomainMemoryStatTags(stat.Tag)]
+		if !ok {
+			log.Debugf("Ignoring unknown memory statistic %d", stat.Tag)
+			continue
+		}
+		statsMap[name] = stat.Val
+	}
+	return statsMap
+}
+
+// SetMemoryStatsPeriod changes how often the guest reports its memory
+// statistics, 0 disables the reports. The VM must have been created with a
+// non-zero MemoryStatsPeriod so that it has a balloon device.
+func (d *Driver) SetMemoryStatsPeriod(seconds int) error {
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	running, err := d.isRunning()
+	if err != nil {
+		return err
+	}
+	if err := d.vm.SetMemoryStatsPeriod(seconds, memoryUpdateFlags(running)); err != nil {
+		return fmt.Errorf("Failed to set memory statistics period, was the VM created with a balloon device? %w", err)
+	}
+	d.MemoryStatsPeriod = seconds
+	return nil
+}
+
+// GetMemoryStats returns the memory statistics of the running VM, in KiB
+// except for the fault counters and last_update which is a timestamp. The
+// statistics reported by the guest are only available when
+// MemoryStatsPeriod is set.
+func (d *Driver) GetMemoryStats() (map[string]uint64, error) {
+	if err := d.validateVMRef(); err != nil {
+		return nil, err
+	}
+	if err := d.checkRunning(); err != nil {
+		return nil, err
+	}
+	stats, err := d.vm.MemoryStats(uint32(libvirt.DOMAIN_MEMORY_STAT_NR), 0)
+	if err != nil {
+		return nil, err
+	}
+	return memoryStatsToMap(stats), nil
+}
+
+// BlockStats holds the IO counters of the VM disk
+type BlockStats struct {
+	ReadRequests  int64
+	ReadBytes     int64
+	WriteRequests int64
+	WriteBytes    int64
+	Errors        int64
+}
+
+// GetBlockStats returns the IO counters of the disk of the running VM
+func (d *Driver) GetBlockStats() (*BlockStats, error) {
+	if err := d.validateVMRef(); err != nil {
+		return nil, err
+	}
+	if err := d.checkRunning(); err != nil {
+		return nil, err
+	}
+	stats, err := d.vm.BlockStats(d.getDiskTarget())
+	if err != nil {
+		return nil, err
+	}
+	return &BlockStats{
+		ReadRequests:  stats.RdReq,
+		ReadBytes:     stats.RdBytes,
+		WriteRequests: stats.WrReq,
+		WriteBytes:    stats.WrBytes,
+		Errors:        stats.Errs,
+	}, nil
+}
+
+// InterfaceStats holds the traffic counters of the VM network interface
+type InterfaceStats struct {
+	RxBytes   int64
+	RxPackets int64
+	RxErrors  int64
+	RxDrops   int64
+	TxBytes   int64
+	TxPackets int64
+	TxErrors  int64
+	TxDrops   int64
+}
+
+// interfaceTarget returns the name of the host device of the VM network
+// interface, such as vnet0, from the XML of the running domain
+func interfaceTarget(xmldoc string) (string, error) {
+	var domain libvirtxml.Domain
+	if err := domain.Unmarshal(xmldoc); err != nil {
+		return "", err
+	}
+	if domain.Devices != nil {
+		for _, iface := range domain.Devices.Interfaces {
+			if iface.MAC == nil || iface.MAC.Address != macAddress {
+				continue
+			}
+			if iface.Target != nil && iface.Target.Dev != "" {
+				return iface.Target.Dev, nil
+			}
+		}
+	}
+	return "", errors.New("Network interface of the VM not found")
+}
+
+// GetInterfaceStats returns the traffic counters of the network interface of
+// the running VM
+func (d *Driver) GetInterfaceStats() (*InterfaceStats, error) {
+	if err := d.validateVMRef(); err != nil {
+		return nil, err
+	}
+	if err := d.checkRunning(); err != nil {
+		return nil, err
+	}
+	xmldoc, err := d.vm.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+	target, err := interfaceTarget(xmldoc)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := d.vm.InterfaceStats(target)
+	if err != nil {
+		return nil, err
+	}
+	return &InterfaceStats{
+		RxBytes:   stats.RxBytes,
+		RxPackets: stats.RxPackets,
+		RxErrors:  stats.RxErrs,
+		RxDrops:   stats.RxDrop,
+		TxBytes:   stats.TxBytes,
+		TxPackets: stats.TxPackets,
+		TxErrors:  stats.TxErrs,
+		TxDrops:   stats.TxDrop,
+	}, nil
+}
+
+// VcpuStat holds the state and CPU usage of a virtual CPU of the VM
+type VcpuStat struct {
+	Number uint32
+	// State is offline, running or blocked
+	State string
+	// CPUTime is the CPU time used by the virtual CPU in nanoseconds
+	CPUTime uint64
+	// HostCPU is the host CPU the virtual CPU is currently running on
+	HostCPU int32
+	// PinnedCPUs are the host CPUs the virtual CPU may run on, it is
+	// empty when the virtual CPU is not pinned
+	PinnedCPUs []int
+}
+
+func vcpuState(state int32) string {
+	switch libvirt.VcpuState(state) {
+	case libvirt.VCPU_OFFLINE:
+		return "offline"
+	case libvirt.VCPU_RUNNING:
+		return "running"
+	case libvirt.VCPU_BLOCKED:
+		return "blocked"
+	default:
+		return "unknown"
+	}
+}
+
+func toVcpuStats(infos []libvirt.DomainVcpuInfo) []VcpuStat {
+	stats := make([]VcpuStat, 0, len(infos))
+	for _, info := range infos {
+		stat := VcpuStat{
+			Number:  info.Number,
+			State:   vcpuState(info.State),
+			CPUTime: info.CpuTime,
+			HostCPU: info.Cpu,
+		}
+		var pinned []int
+		for cpu, usable := range info.CpuMap {
+			if usable {
+				pinned = append(pinned, cpu)
+			}
+		}
+		// Without pinning, all host CPUs can be used
+		if len(pinned) != len(info.CpuMap) {
+			stat.PinnedCPUs = pinned
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+// GetVcpuStats returns the state and CPU usage of each virtual CPU of the
+// running VM
+func (d *Driver) GetVcpuStats() ([]VcpuStat, error) {
+	if err := d.validateVMRef(); err != nil {
+		return nil, err
+	}
+	if err := d.checkRunning(); err != nil {
+		return nil, err
+	}
+	infos, err := d.vm.GetVcpus()
+	if err != nil {
+		return nil, err
+	}
+	return toVcpuStats(infos), nil
+}
+
+// DomainStats holds the statistics of a domain returned by GetAllStats, the
+// counters of a domain which is not running are zero
+type DomainStats struct {
+	Name  string
+	State state.State
+	// CPUTime is the CPU time used by the domain in nanoseconds
+	CPUTime uint64
+	// Memory and MaxMemory are the current and maximum memory of the domain
+	// in KiB
+	Memory    uint64
+	MaxMemory uint64
+	Vcpus     []VcpuStat
+	// Interfaces and Disks are indexed by host device name and disk target
+	Interfaces map[string]InterfaceStats
+	Disks      map[string]BlockStats
+}
+
+const allStatsTypes = libvirt.DOMAIN_STATS_STATE | libvirt.DOMAIN_STATS_CPU_TOTAL | libvirt.DOMAIN_STATS_BALLOON |
+	libvirt.DOMAIN_STATS_VCPU | libvirt.DOMAIN_STATS_INTERFACE | libvirt.DOMAIN_STATS_BLOCK
+
+// GetAllStats returns the statistics of the domains of the connection in a
+// single call. When crcOnly is true, only the domains created by this driver,
+// which have CRC metadata, are included.
+func GetAllStats(conn *libvirt.Connect, crcOnly bool) ([]DomainStats, error) {
+	var doms []*libvirt.Domain
+	if crcOnly {
+		crcDoms, err := listCRCDomains(conn)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			for _, dom := range crcDoms {
+				_ = dom.Free()
+			}
+		}()
+		if len(crcDoms) == 0 {
+			return nil, nil
+		}
+		doms = crcDoms
+	}
+	allStats, err := conn.GetAllDomainStats(doms, allStatsTypes, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get domain statistics: %w", err)
+	}
+	stats := make([]DomainStats, 0, len(allStats))
+	for _, domStats := range allStats {
+		name, err := domStats.Domain.GetName()
+		_ = domStats.Domain.Free()
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, toDomainStats(name, domStats))
+	}
+	return stats, nil
+}
+
+// listCRCDomains returns the domains of the connection which have CRC
+// metadata, the caller must free them
+func listCRCDomains(conn *libvirt.Connect) ([]*libvirt.Domain, error) {
+	doms, err := conn.ListAllDomains(0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list domains: %w", err)
+	}
+	var crcDoms []*libvirt.Domain
+	for i := range doms {
+		dom := &doms[i]
+		if _, err := dom.GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, metadataNamespace, libvirt.DOMAIN_AFFECT_CONFIG); err != nil {
+			_ = dom.Free()
+			continue
+		}
+		crcDoms = append(crcDoms, dom)
+	}
+	return crcDoms, nil
+}
+
+func toDomainStats(name string, stats libvirt.DomainStats) DomainStats {
+	domStats := DomainStats{
+		Name:       name,
+		State:      state.Error,
+		Interfaces: map[string]InterfaceStats{},
+		Disks:      map[string]BlockStats{},
+	}
+	if stats.State != nil && stats.State.StateSet {
+		if vmState, err := toMachineState(stats.State.State, stats.State.Reason); err == nil {
+			domStats.State = vmState
+		}
+	}
+	if stats.Cpu != nil {
+		domStats.CPUTime = stats.Cpu.Time
+	}
+	if stats.Balloon != nil {
+		domStats.Memory = stats.Balloon.Current
+		domStats.MaxMemory = stats.Balloon.Maximum
+	}
+	for i, vcpu := range stats.Vcpu {
+		domStats.Vcpus = append(domStats.Vcpus, VcpuStat{
+			Number:  uint32(i),
+			State:   vcpuState(int32(vcpu.State)),
+			CPUTime: vcpu.Time,
+		})
+	}
+	for _, net := range stats.Net {
+		domStats.Interfaces[net.Name] = InterfaceStats{
+			RxBytes:   int64(net.RxBytes),
+			RxPackets: int64(net.RxPkts),
+			RxErrors:  int64(net.RxErrs),
+			RxDrops:   int64(net.RxDrop),
+			TxBytes:   int64(net.TxBytes),
+			TxPackets: int64(net.TxPkts),
+			TxErrors:  int64(net.TxErrs),
+			TxDrops:   int64(net.TxDrop),
+		}
+	}
+	for _, block := range stats.Block {
+		domStats.Disks[block.Name] = BlockStats{
+			ReadRequests:  int64(block.RdReqs),
+			ReadBytes:     int64(block.RdBytes),
+			WriteRequests: int64(block.WrReqs),
+			WriteBytes:    int64(block.WrBytes),
+			Errors:        int64(block.Errors),
+		}
+	}
+	return domStats
+}
@@ -0,0 +1,110 @@
+package libvirt
+
+import (
+	"testing"
+
+	"github.com/crc-org/machine/libmachine/state"
+	"github.com/stretchr/testify/assert"
+	"libvirt.org/go/libvirt"
+)
+
+func TestMemoryStatsToMap(t *testing.T) {
+	stats := memoryStatsToMap([]libvirt.DomainMemoryStat{
+		{Tag: int32(libvirt.DOMAIN_MEMORY_STAT_ACTUAL_BALLOON), Val: 8388608},
+		{Tag: int32(libvirt.DOMAIN_MEMORY_STAT_RSS), Val: 2097152},
+		{Tag: int32(libvirt.DOMAIN_MEMORY_STAT_UNUSED), Val: 4194304},
+		{Tag: 1000, Val: 1},
+	})
+	assert.Equal(t, map[string]uint64{
+		"actual": 8388608,
+		"rss":    2097152,
+		"unused": 4194304,
+	}, stats)
+}
+
+func TestInterfaceTarget(t *testing.T) {
+	target, err := interfaceTarget(`<domain>
+  <devices>
+    <interface type="network">
+      <mac address="52:54:00:12:34:56"></mac>
+      <target dev="vnet0"></target>
+    </interface>
+    <interface type="network">
+      <mac address="52:fd:fc:07:21:82"></mac>
+      <source network="crc"></source>
+      <target dev="vnet1"></target>
+    </interface>
+  </devices>
+</domain>`)
+	assert.NoError(t, err)
+	assert.Equal(t, "vnet1", target)
+
+	_, err = interfaceTarget(`<domain><devices></devices></domain>`)
+	assert.Error(t, err)
+}
+
+func TestToVcpuStats(t *testing.T) {
+	stats := toVcpuStats([]libvirt.DomainVcpuInfo{
+		{Number: 0, State: int32(libvirt.VCPU_RUNNING), CpuTime: 1000, Cpu: 3, CpuMap: []bool{true, true, true, true}},
+		{Number: 1, State: int32(libvirt.VCPU_BLOCKED), CpuTime: 2000, Cpu: 2, CpuMap: []bool{false, false, true, false}},
+	})
+	assert.Equal(t, []VcpuStat{
+		{Number: 0, State: "running", CPUTime: 1000, HostCPU: 3},
+		{Number: 1, State: "blocked", CPUTime: 2000, HostCPU: 2, PinnedCPUs: []int{2}},
+	}, stats)
+}
+
+func TestResourceWarnings(t *testing.T) {
+	resources := &HostResources{TotalMemory: 16384, FreeMemory: 8192, CPUs: 8}
+	assert.Empty(t, resourceWarnings(resources, 4096, 4))
+	assert.Len(t, resourceWarnings(resources, 10240, 4), 1)
+	assert.Len(t, resourceWarnings(resources, 10240, 12), 2)
+}
+
+func TestToDomainStats(t *testing.T) {
+	stats := toDomainStats("crc", libvirt.DomainStats{
+		State: &libvirt.DomainStatsState{
+			StateSet: true,
+			State:    libvirt.DOMAIN_RUNNING,
+		},
+		Cpu: &libvirt.DomainStatsCPU{
+			TimeSet: true,
+			Time:    1000,
+		},
+		Balloon: &libvirt.DomainStatsBalloon{
+			Current: 4194304,
+			Maximum: 8388608,
+		},
+		Vcpu: []libvirt.DomainStatsVcpu{
+			{State: libvirt.VCPU_RUNNING, Time: 400},
+			{State: libvirt.VCPU_BLOCKED, Time: 600},
+		},
+		Net: []libvirt.DomainStatsNet{
+			{Name: "vnet0", RxBytes: 100, TxBytes: 200},
+		},
+		Block: []libvirt.DomainStatsBlock{
+			{Name: "vda", RdBytes: 300, WrBytes: 400},
+		},
+	})
+	assert.Equal(t, "crc", stats.Name)
+	assert.Equal(t, state.Running, stats.State)
+	assert.Equal(t, uint64(1000), stats.CPUTime)
+	assert.Equal(t, uint64(4194304), stats.Memory)
+	assert.Equal(t, uint64(8388608), stats.MaxMemory)
+	assert.Equal(t, []VcpuStat{
+		{Number: 0, State: "running", CPUTime: 400},
+		{Number: 1, State: "blocked", CPUTime: 600},
+	}, stats.Vcpus)
+	assert.Equal(t, InterfaceStats{RxBytes: 100, TxBytes: 200}, stats.Interfaces["vnet0"])
+	assert.Equal(t, BlockStats{ReadBytes: 300, WriteBytes: 400}, stats.Disks["vda"])
+
+	stats = toDomainStats("stopped", libvirt.DomainStats{})
+	assert.Equal(t, state.Error, stats.State)
+	assert.Empty(t, stats.Disks)
+}
+
+func TestCheckRAMDiskMemory(t *testing.T) {
+	resources := &HostResources{TotalMemory: 32768, FreeMemory: 16384, CPUs: 8}
+	assert.NoError(t, checkRAMDiskMemory(resources, 8192, 8*1024*1024*1024))
+	assert.Error(t, checkRAMDiskMemory(resources, 8192, 16*1024*1024*1024))
+}
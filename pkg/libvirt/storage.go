@@ -1,8 +1,13 @@
 package libvirt
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"libvirt.org/go/libvirt"
@@ -12,7 +17,7 @@ import (
 func (d *Driver) activateStoragePool(pool *libvirt.StoragePool) error {
 	log.Debugf("Activating pool '%s'", d.getStoragePoolName())
 
-	if err := os.MkdirAll(d.ResolveStorePath("."), 0755); err != nil {
+	if err := os.MkdirAll(d.getStoragePoolPath(), 0755); err != nil {
 		return err
 	}
 
@@ -38,22 +43,130 @@ func (d *Driver) validateStoragePool() error {
 	return nil
 }
 
+// checkPoolTarget fails when the target directory of the storage pool with
+// the given XML is not path
+func checkPoolTarget(poolXML string, path string) error {
+	var pool libvirtxml.StoragePool
+	if err := pool.Unmarshal(poolXML); err != nil {
+		return err
+	}
+	if pool.Target == nil || filepath.Clean(pool.Target.Path) != filepath.Clean(path) {
+		target := ""
+		if pool.Target != nil {
+			target = pool.Target.Path
+		}
+		return fmt.Errorf("Storage pool %s already exists with target %s, the VM disks would be created outside of it in %s: set the storage pool path to %s or use another storage pool", pool.Name, target, path, target)
+	}
+	return nil
+}
+
+// checkStoragePoolPath checks the existing storage pool uses the directory
+// the VM disk images are created in, or they would not be part of the pool
+func (d *Driver) checkStoragePoolPath() error {
+	pool, err := d.getPool()
+	if err != nil {
+		return err
+	}
+	defer pool.Free() // nolint:errcheck
+
+	xmldoc, err := pool.GetXMLDesc(0)
+	if err != nil {
+		return err
+	}
+	return checkPoolTarget(xmldoc, d.getStoragePoolPath())
+}
+
 func (d *Driver) getStoragePoolName() string {
 	if d.StoragePool != "" {
 		return d.StoragePool
 	}
+	// The pool named after the machine usually exists already and points
+	// to the store directory, the RAM disk needs a pool of its own
+	if d.RAMDisk {
+		return ramDiskPoolPrefix + d.MachineName
+	}
 	if d.MachineName != "" {
 		return d.MachineName
 	}
 	return DefaultPool
 }
 
+// freeDiskSpace returns the space in bytes available to unprivileged users on
+// the filesystem of path, or of its closest existing parent directory
+func freeDiskSpace(path string) (uint64, error) {
+	for {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(path, &stat)
+		if err == nil {
+			return stat.Bavail * uint64(stat.Bsize), nil
+		}
+		parent := filepath.Dir(path)
+		if !errors.Is(err, os.ErrNotExist) || parent == path {
+			return 0, err
+		}
+		path = parent
+	}
+}
+
+// checkDiskSpace checks the storage pool directory has enough free space for
+// the VM disks to grow to their full size
+func (d *Driver) checkDiskSpace() error {
+	required := d.DiskCapacity + d.ExtraDiskSize*1024*1024*1024
+	free, err := freeDiskSpace(d.getStoragePoolPath())
+	if err != nil {
+		return err
+	}
+	if free >= required {
+		return nil
+	}
+	msg := fmt.Sprintf("Only %d MiB are free in %s, the VM disks can use up to %d MiB", free/1024/1024, d.getStoragePoolPath(), required/1024/1024)
+	if d.FailOnLowDiskSpace {
+		return errors.New(msg)
+	}
+	log.Warn(msg)
+	return nil
+}
+
+// poolRefreshRetryDelay is the initial delay between two storage pool refresh
+// attempts
+var poolRefreshRetryDelay = 200 * time.Millisecond
+
+const poolRefreshRetries = 5
+
+// isConcurrentRefreshError returns true when the pool refresh failed because
+// another operation on the pool, such as a refresh, is still running
+func isConcurrentRefreshError(err error) bool {
+	var virErr libvirt.Error
+	if !errors.As(err, &virErr) {
+		return false
+	}
+	return virErr.Code == libvirt.ERR_INTERNAL_ERROR && strings.Contains(virErr.Message, "asynchronous jobs running")
+}
+
+// retryPoolRefresh calls refresh until it succeeds, retrying only while the
+// pool is busy with concurrent operations
+func retryPoolRefresh(refresh func() error) error {
+	delay := poolRefreshRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := refresh()
+		if err == nil || attempt > poolRefreshRetries || !isConcurrentRefreshError(err) {
+			return err
+		}
+		log.Debugf("Storage pool is busy (attempt %d/%d), retrying: %v", attempt, poolRefreshRetries+1, err)
+		time.Sleep(delay)
+		delay = nextBackoff(delay, 2*time.Second)
+	}
+}
+
 func (d *Driver) refreshStoragePool() error {
 	pool, err := d.getPool()
 	if err != nil {
 		return err
 	}
-	return pool.Refresh(0)
+	defer pool.Free() // nolint:errcheck
+	return retryPoolRefresh(func() error {
+		return pool.Refresh(0)
+	})
 }
 
 func (d *Driver) createStoragePool() (*libvirt.StoragePool, error) {
@@ -68,7 +181,7 @@ func (d *Driver) createStoragePool() (*libvirt.StoragePool, error) {
 		Name: poolName,
 		Type: "dir",
 		Target: &libvirtxml.StoragePoolTarget{
-			Path: d.ResolveStorePath("."),
+			Path: d.getStoragePoolPath(),
 		},
 	}
 	poolXML, err := poolConfig.Marshal()
@@ -78,7 +191,7 @@ func (d *Driver) createStoragePool() (*libvirt.StoragePool, error) {
 	log.Infof("Creating storage pool with XML %s", poolXML)
 	pool, err := conn.StoragePoolDefineXML(poolXML, 0)
 	if err != nil {
-		log.Debugf("Could not create storage pool %s", d.StoragePool)
+		log.Debugf("Could not create storage pool %s", poolName)
 		return nil, fmt.Errorf("Use 'crc setup' to define the storage pool, %+v", err)
 	}
 	err = d.activateStoragePool(pool)
@@ -110,14 +223,27 @@ func (d *Driver) getPool() (*libvirt.StoragePool, error) {
 	return pool, nil
 }
 
+// getActiveDiskFilename returns the file name of the image the VM writes to,
+// which is the overlay of the last external snapshot once one was taken
+func (d *Driver) getActiveDiskFilename() string {
+	if len(d.ExternalSnapshots) != 0 {
+		return filepath.Base(d.ExternalSnapshots[len(d.ExternalSnapshots)-1])
+	}
+	return d.getDiskImageFilename()
+}
+
 func (d *Driver) getVolume() (*libvirt.StorageVol, error) {
+	return d.getVolumeByName(d.getActiveDiskFilename())
+}
+
+func (d *Driver) getVolumeByName(name string) (*libvirt.StorageVol, error) {
 	pool, err := d.getPool()
 	if err != nil {
 		return nil, err
 	}
 	defer pool.Free() // nolint:errcheck
 
-	vol, err := pool.LookupStorageVolByName(d.getDiskImageFilename())
+	vol, err := pool.LookupStorageVolByName(name)
 	if err != nil {
 		return nil, err
 	}
@@ -125,13 +251,117 @@ func (d *Driver) getVolume() (*libvirt.StorageVol, error) {
 	return vol, nil
 }
 
-func (d *Driver) getVolCapacity() (uint64, error) {
+// removeRAMDiskDir removes the empty tmpfs directory of a RAM disk storage
+// pool, it is not an error if it does not exist
+func removeRAMDiskDir(dir string) error {
+	if !isInDir(dir, ramDiskDir) {
+		return fmt.Errorf("%s is not a RAM disk directory", dir)
+	}
+	return removeFile(dir)
+}
+
+// removeRAMDiskPool removes the storage pool dedicated to the RAM disk of the
+// VM and its directory, the disk images must have been removed first
+func (d *Driver) removeRAMDiskPool() error {
+	log.Debugf("Removing storage pool %s", d.getStoragePoolName())
+	conn, err := d.getConn()
+	if err != nil {
+		return err
+	}
+	pool, err := conn.LookupStoragePoolByName(d.getStoragePoolName())
+	if err != nil {
+		var virErr libvirt.Error
+		if !errors.As(err, &virErr) || virErr.Code != libvirt.ERR_NO_STORAGE_POOL {
+			return err
+		}
+	} else {
+		defer pool.Free() // nolint:errcheck
+		if active, _ := pool.IsActive(); active {
+			if err := pool.Destroy(); err != nil {
+				return fmt.Errorf("Failed to stop storage pool %s: %w", d.getStoragePoolName(), err)
+			}
+		}
+		if err := pool.Undefine(); err != nil {
+			return fmt.Errorf("Failed to remove storage pool %s: %w", d.getStoragePoolName(), err)
+		}
+	}
+	return removeRAMDiskDir(d.getStoragePoolPath())
+}
+
+func (d *Driver) getExtraDiskFilename() string {
+	return fmt.Sprintf("%s-extra.qcow2", d.MachineName)
+}
+
+// GetExtraDiskPath returns the path of the additional data disk of the VM
+func (d *Driver) GetExtraDiskPath() string {
+	return filepath.Join(d.getStoragePoolPath(), d.getExtraDiskFilename())
+}
+
+func (d *Driver) createExtraDisk() error {
+	log.Debugf("Creating %d GiB extra disk %s", d.ExtraDiskSize, d.getExtraDiskFilename())
+	pool, err := d.getPool()
+	if err != nil {
+		return err
+	}
+	defer pool.Free() // nolint:errcheck
+
+	volConfig := libvirtxml.StorageVolume{
+		Name: d.getExtraDiskFilename(),
+		Capacity: &libvirtxml.StorageVolumeSize{
+			Unit:  "GiB",
+			Value: d.ExtraDiskSize,
+		},
+		Target: &libvirtxml.StorageVolumeTarget{
+			Format: &libvirtxml.StorageVolumeTargetFormat{
+				Type: "qcow2",
+			},
+		},
+	}
+	volXML, err := volConfig.Marshal()
+	if err != nil {
+		return err
+	}
+	vol, err := pool.StorageVolCreateXML(volXML, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to create extra disk: %w", err)
+	}
+
+	return vol.Free()
+}
+
+// removeVolume deletes a volume of the storage pool, and its file in case it
+// is not known to the pool. It is not an error if the volume does not exist.
+func (d *Driver) removeVolume(name, path string) error {
+	log.Debugf("Removing disk image %s", name)
+	vol, err := d.getVolumeByName(name)
+	if err != nil {
+		var virErr libvirt.Error
+		if !errors.As(err, &virErr) || virErr.Code != libvirt.ERR_NO_STORAGE_VOL {
+			return err
+		}
+		return removeFile(path)
+	}
+	defer vol.Free() // nolint:errcheck
+
+	return vol.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
+}
+
+func (d *Driver) getVolInfo() (*libvirt.StorageVolInfo, error) {
 	vol, err := d.getVolume()
 	if err != nil {
-		return 0, err
+		var virErr libvirt.Error
+		if errors.As(err, &virErr) && virErr.Code == libvirt.ERR_NO_STORAGE_VOL {
+			return nil, fmt.Errorf("Disk image %s does not exist in storage pool %s: %w", d.getActiveDiskFilename(), d.getStoragePoolName(), err)
+		}
+		return nil, err
 	}
 	defer vol.Free() // nolint:errcheck
-	volInfo, err := vol.GetInfoFlags(libvirt.STORAGE_VOL_USE_ALLOCATION)
+
+	return vol.GetInfoFlags(libvirt.STORAGE_VOL_USE_ALLOCATION)
+}
+
+func (d *Driver) getVolCapacity() (uint64, error) {
+	volInfo, err := d.getVolInfo()
 	if err != nil {
 		return 0, err
 	}
@@ -139,6 +369,22 @@ func (d *Driver) getVolCapacity() (uint64, error) {
 	return volInfo.Capacity, nil
 }
 
+// GetDiskCapacity returns the virtual size in bytes of the VM disk image
+func (d *Driver) GetDiskCapacity() (uint64, error) {
+	return d.getVolCapacity()
+}
+
+// GetDiskAllocation returns the disk space in bytes used on the host by the
+// VM disk image
+func (d *Driver) GetDiskAllocation() (uint64, error) {
+	volInfo, err := d.getVolInfo()
+	if err != nil {
+		return 0, err
+	}
+
+	return volInfo.Allocation, nil
+}
+
 func (d *Driver) checkIfResizeNeeded(newCapacity uint64) (bool, error) {
 	if newCapacity == 0 {
 		return false, nil
@@ -175,6 +421,14 @@ func (d *Driver) resizeDiskImageIfNeeded(newCapacity uint64) (bool, error) {
 
 func (d *Driver) resizeDiskImage(newCapacity uint64) error {
 	log.Debugf("resizeDiskImage(%d)", newCapacity)
+	running, err := d.isRunning()
+	if err != nil {
+		return err
+	}
+	if running {
+		return d.resizeDiskImageOnline(newCapacity)
+	}
+
 	vol, err := d.getVolume()
 	if err != nil {
 		return err
@@ -189,3 +443,21 @@ func (d *Driver) resizeDiskImage(newCapacity uint64) error {
 
 	return err
 }
+
+// resizeDiskImageOnline grows the disk of the running VM through QEMU, which
+// has the image open, so that the guest sees the new disk size. The guest
+// partition and filesystem are then grown when GrowGuestFilesystem is set.
+func (d *Driver) resizeDiskImageOnline(newCapacity uint64) error {
+	log.Debugf("resizing disk of running VM to %d", newCapacity)
+	if err := d.vm.BlockResize(d.getDiskTarget(), newCapacity, libvirt.DOMAIN_BLOCK_RESIZE_BYTES); err != nil {
+		return err
+	}
+	d.DiskCapacity = newCapacity
+
+	if d.GrowGuestFilesystem {
+		if err := d.growGuestFilesystem(); err != nil {
+			log.Warnf("Failed to grow the root filesystem of VM %s, it must be grown from the VM: %v", d.MachineName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package libvirt
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"libvirt.org/go/libvirt"
+)
+
+func TestRetryPoolRefresh(t *testing.T) {
+	defer func(delay time.Duration) {
+		poolRefreshRetryDelay = delay
+	}(poolRefreshRetryDelay)
+	poolRefreshRetryDelay = time.Millisecond
+
+	busyErr := libvirt.Error{Code: libvirt.ERR_INTERNAL_ERROR, Message: "internal error: pool 'crc' has asynchronous jobs running."}
+	var attempts int
+	refreshErr := func(failures int, err error) func() error {
+		attempts = 0
+		return func() error {
+			attempts++
+			if attempts <= failures {
+				return err
+			}
+			return nil
+		}
+	}
+
+	assert.NoError(t, retryPoolRefresh(refreshErr(2, busyErr)))
+	assert.Equal(t, 3, attempts)
+
+	assert.ErrorIs(t, retryPoolRefresh(refreshErr(10, busyErr)), busyErr)
+	assert.Equal(t, poolRefreshRetries+1, attempts)
+
+	noPoolErr := libvirt.Error{Code: libvirt.ERR_NO_STORAGE_POOL, Message: "Storage pool not found"}
+	assert.ErrorIs(t, retryPoolRefresh(refreshErr(10, noPoolErr)), noPoolErr)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestFreeDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	free, err := freeDiskSpace(dir)
+	assert.NoError(t, err)
+	assert.NotZero(t, free)
+
+	missingFree, err := freeDiskSpace(filepath.Join(dir, "machines", "crc"))
+	assert.NoError(t, err)
+	assert.NotZero(t, missingFree)
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	d := testDriver()
+	d.StoragePoolPath = t.TempDir()
+	d.DiskCapacity = 1024 * 1024
+	assert.NoError(t, d.checkDiskSpace())
+
+	d.DiskCapacity = math.MaxUint64 / 2
+	assert.NoError(t, d.checkDiskSpace())
+	d.FailOnLowDiskSpace = true
+	assert.ErrorContains(t, d.checkDiskSpace(), "the VM disks can use up to")
+}
+
+func TestCheckPoolTarget(t *testing.T) {
+	poolXML := `<pool type="dir">
+  <name>crc</name>
+  <target>
+    <path>/home/user/.crc/machines/crc</path>
+  </target>
+</pool>`
+	assert.NoError(t, checkPoolTarget(poolXML, "/home/user/.crc/machines/crc"))
+	assert.NoError(t, checkPoolTarget(poolXML, "/home/user/.crc/machines/crc/"))
+	assert.Error(t, checkPoolTarget(poolXML, "/var/lib/crc"))
+}
+
+func TestRemoveRAMDiskDir(t *testing.T) {
+	dir, err := os.MkdirTemp(ramDiskDir, "crc-test-")
+	if err != nil {
+		t.Skipf("%s is not usable: %v", ramDiskDir, err)
+	}
+	defer os.RemoveAll(dir) // nolint:errcheck
+
+	assert.NoError(t, removeRAMDiskDir(dir))
+	assert.NoDirExists(t, dir)
+	assert.NoError(t, removeRAMDiskDir(dir))
+
+	assert.Error(t, removeRAMDiskDir(t.TempDir()))
+	assert.Error(t, removeRAMDiskDir(ramDiskDir))
+}
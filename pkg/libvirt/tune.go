@@ -0,0 +1,352 @@
+package libvirt
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+func (d *Driver) diskIOTune() *libvirtxml.DomainDiskIOTune {
+	if d.DiskReadBytesSec == 0 && d.DiskWriteBytesSec == 0 && d.DiskReadIopsSec == 0 && d.DiskWriteIopsSec == 0 {
+		return nil
+	}
+	return &libvirtxml.DomainDiskIOTune{
+		ReadBytesSec:  d.DiskReadBytesSec,
+		WriteBytesSec: d.DiskWriteBytesSec,
+		ReadIopsSec:   d.DiskReadIopsSec,
+		WriteIopsSec:  d.DiskWriteIopsSec,
+	}
+}
+
+// validateCPUTune checks the CPU scheduler settings are in the ranges accepted
+// by libvirt, 0 values are unset
+func validateCPUTune(shares uint, quota int64, period uint64) error {
+	if shares != 0 && (shares < 2 || shares > 262144) {
+		return fmt.Errorf("Invalid CPU shares %d, must be between 2 and 262144", shares)
+	}
+	if quota != 0 && quota != -1 && (quota < 1000 || quota > 17592186044415) {
+		return fmt.Errorf("Invalid CPU quota %d, must be -1 or between 1000 and 17592186044415", quota)
+	}
+	if period != 0 && (period < 1000 || period > 1000000) {
+		return fmt.Errorf("Invalid CPU period %d, must be between 1000 and 1000000", period)
+	}
+	return nil
+}
+
+func (d *Driver) cpuTune() *libvirtxml.DomainCPUTune {
+	if d.CPUShares == 0 && d.CPUQuota == 0 && d.CPUPeriod == 0 {
+		return nil
+	}
+	cputune := &libvirtxml.DomainCPUTune{}
+	if d.CPUShares != 0 {
+		cputune.Shares = &libvirtxml.DomainCPUTuneShares{Value: d.CPUShares}
+	}
+	if d.CPUPeriod != 0 {
+		cputune.Period = &libvirtxml.DomainCPUTunePeriod{Value: d.CPUPeriod}
+	}
+	if d.CPUQuota != 0 {
+		cputune.Quota = &libvirtxml.DomainCPUTuneQuota{Value: d.CPUQuota}
+	}
+	return cputune
+}
+
+// validateMemoryTune checks the memory limits in MiB are consistent with each
+// other and with the VM memory, 0 values are unset
+func validateMemoryTune(memory int, hardLimit, softLimit, swapHardLimit uint64) error {
+	if hardLimit != 0 && hardLimit < uint64(memory) {
+		return fmt.Errorf("Memory hard limit %d MiB is lower than the VM memory %d MiB", hardLimit, memory)
+	}
+	if softLimit != 0 && hardLimit != 0 && softLimit > hardLimit {
+		return fmt.Errorf("Memory soft limit %d MiB is higher than the hard limit %d MiB", softLimit, hardLimit)
+	}
+	if swapHardLimit != 0 && swapHardLimit < hardLimit {
+		return fmt.Errorf("Swap hard limit %d MiB is lower than the memory hard limit %d MiB", swapHardLimit, hardLimit)
+	}
+	return nil
+}
+
+func memoryTuneLimit(limit uint64) *libvirtxml.DomainMemoryTuneLimit {
+	if limit == 0 {
+		return nil
+	}
+	return &libvirtxml.DomainMemoryTuneLimit{
+		Value: limit,
+		Unit:  "MiB",
+	}
+}
+
+func (d *Driver) memoryTune() *libvirtxml.DomainMemoryTune {
+	if d.MemoryHardLimit == 0 && d.MemorySoftLimit == 0 && d.MemorySwapHardLimit == 0 {
+		return nil
+	}
+	return &libvirtxml.DomainMemoryTune{
+		HardLimit:     memoryTuneLimit(d.MemoryHardLimit),
+		SoftLimit:     memoryTuneLimit(d.MemorySoftLimit),
+		SwapHardLimit: memoryTuneLimit(d.MemorySwapHardLimit),
+	}
+}
+
+func bandwidthParams(average int) *libvirtxml.DomainInterfaceBandwidthParams {
+	if average == 0 {
+		return nil
+	}
+	return &libvirtxml.DomainInterfaceBandwidthParams{
+		Average: &average,
+	}
+}
+
+func (d *Driver) interfaceBandwidth() *libvirtxml.DomainInterfaceBandwidth {
+	if d.NetInboundKBps == 0 && d.NetOutboundKBps == 0 {
+		return nil
+	}
+	return &libvirtxml.DomainInterfaceBandwidth{
+		Inbound:  bandwidthParams(d.NetInboundKBps),
+		Outbound: bandwidthParams(d.NetOutboundKBps),
+	}
+}
+
+// modificationImpact returns the flags to use to change a setting in the
+// domain configuration, and in the running VM if it is running
+func (d *Driver) modificationImpact() (libvirt.DomainModificationImpact, error) {
+	running, err := d.isRunning()
+	if err != nil {
+		return 0, err
+	}
+	if running {
+		return libvirt.DOMAIN_AFFECT_CONFIG | libvirt.DOMAIN_AFFECT_LIVE, nil
+	}
+	return libvirt.DOMAIN_AFFECT_CONFIG, nil
+}
+
+// SetDiskIOTune changes the throughput limits of the VM disk, a 0 value
+// removes the corresponding limit. The limits are applied to the running VM
+// and saved in its configuration.
+func (d *Driver) SetDiskIOTune(readBytesSec, writeBytesSec, readIopsSec, writeIopsSec uint64) error {
+	log.Debugf("Setting disk IO limits of VM %s", d.MachineName)
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	flags, err := d.modificationImpact()
+	if err != nil {
+		return err
+	}
+	params := &libvirt.DomainBlockIoTuneParameters{
+		ReadBytesSecSet:  true,
+		ReadBytesSec:     readBytesSec,
+		WriteBytesSecSet: true,
+		WriteBytesSec:    writeBytesSec,
+		ReadIopsSecSet:   true,
+		ReadIopsSec:      readIopsSec,
+		WriteIopsSecSet:  true,
+		WriteIopsSec:     writeIopsSec,
+	}
+	if err := d.vm.SetBlockIoTune(d.getDiskTarget(), params, flags); err != nil {
+		return err
+	}
+
+	d.DiskReadBytesSec = readBytesSec
+	d.DiskWriteBytesSec = writeBytesSec
+	d.DiskReadIopsSec = readIopsSec
+	d.DiskWriteIopsSec = writeIopsSec
+
+	return nil
+}
+
+// SetNetworkBandwidth changes the average bandwidth limits in KiB/s of the VM
+// network interface, a 0 value removes the corresponding limit. The limits
+// are applied to the running VM and saved in its configuration.
+func (d *Driver) SetNetworkBandwidth(inboundKBps, outboundKBps int) error {
+	log.Debugf("Setting network bandwidth limits of VM %s", d.MachineName)
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	flags, err := d.modificationImpact()
+	if err != nil {
+		return err
+	}
+	params := &libvirt.DomainInterfaceParameters{
+		BandwidthInAverageSet:  true,
+		BandwidthInAverage:     uint(inboundKBps),
+		BandwidthOutAverageSet: true,
+		BandwidthOutAverage:    uint(outboundKBps),
+	}
+	if err := d.vm.SetInterfaceParameters(macAddress, params, flags); err != nil {
+		return err
+	}
+
+	d.NetInboundKBps = inboundKBps
+	d.NetOutboundKBps = outboundKBps
+
+	return nil
+}
+
+// SetCPUTune changes the CPU weight, quota and period of the VM, 0 values are
+// left unchanged. The settings are applied to the running VM and saved in its
+// configuration.
+func (d *Driver) SetCPUTune(shares uint, quota int64, period uint64) error {
+	log.Debugf("Setting CPU scheduler parameters of VM %s", d.MachineName)
+	if err := validateCPUTune(shares, quota, period); err != nil {
+		return err
+	}
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	flags, err := d.modificationImpact()
+	if err != nil {
+		return err
+	}
+	params := &libvirt.DomainSchedulerParameters{
+		CpuSharesSet:  shares != 0,
+		CpuShares:     uint64(shares),
+		VcpuQuotaSet:  quota != 0,
+		VcpuQuota:     quota,
+		VcpuPeriodSet: period != 0,
+		VcpuPeriod:    period,
+	}
+	if err := d.vm.SetSchedulerParametersFlags(params, flags); err != nil {
+		return err
+	}
+
+	if shares != 0 {
+		d.CPUShares = shares
+	}
+	if quota != 0 {
+		d.CPUQuota = quota
+	}
+	if period != 0 {
+		d.CPUPeriod = period
+	}
+
+	return nil
+}
+
+// SetMemoryLimits changes the host memory limits in MiB of the VM, 0 values
+// are left unchanged. The limits are applied to the running VM and saved in
+// its configuration.
+func (d *Driver) SetMemoryLimits(hardLimit, softLimit, swapHardLimit uint64) error {
+	log.Debugf("Setting memory limits of VM %s", d.MachineName)
+	newHardLimit, newSoftLimit, newSwapHardLimit := d.MemoryHardLimit, d.MemorySoftLimit, d.MemorySwapHardLimit
+	if hardLimit != 0 {
+		newHardLimit = hardLimit
+	}
+	if softLimit != 0 {
+		newSoftLimit = softLimit
+	}
+	if swapHardLimit != 0 {
+		newSwapHardLimit = swapHardLimit
+	}
+	if err := validateMemoryTune(d.Memory, newHardLimit, newSoftLimit, newSwapHardLimit); err != nil {
+		return err
+	}
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	flags, err := d.modificationImpact()
+	if err != nil {
+		return err
+	}
+	// libvirt uses KiB
+	params := &libvirt.DomainMemoryParameters{
+		HardLimitSet:     hardLimit != 0,
+		HardLimit:        hardLimit * 1024,
+		SoftLimitSet:     softLimit != 0,
+		SoftLimit:        softLimit * 1024,
+		SwapHardLimitSet: swapHardLimit != 0,
+		SwapHardLimit:    swapHardLimit * 1024,
+	}
+	if err := d.vm.SetMemoryParameters(params, flags); err != nil {
+		return err
+	}
+
+	d.MemoryHardLimit = newHardLimit
+	d.MemorySoftLimit = newSoftLimit
+	d.MemorySwapHardLimit = newSwapHardLimit
+
+	return nil
+}
+
+// updateDiskDriver applies update to the driver element of the target disk
+// in the domain XML
+func updateDiskDriver(xmldoc, target string, update func(*libvirtxml.DomainDiskDriver)) (string, error) {
+	var domain libvirtxml.Domain
+	if err := domain.Unmarshal(xmldoc); err != nil {
+		return "", err
+	}
+	if domain.Devices != nil {
+		for i := range domain.Devices.Disks {
+			disk := &domain.Devices.Disks[i]
+			if disk.Target == nil || disk.Target.Dev != target {
+				continue
+			}
+			if disk.Driver == nil {
+				disk.Driver = &libvirtxml.DomainDiskDriver{}
+			}
+			update(disk.Driver)
+			return domain.Marshal()
+		}
+	}
+	return "", fmt.Errorf("Disk %s not found in the VM definition", target)
+}
+
+// redefineDiskDriver changes the driver of the VM disk in the persistent
+// domain definition, the change is used the next time the VM starts
+func (d *Driver) redefineDiskDriver(update func(*libvirtxml.DomainDiskDriver)) error {
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	xmldoc, err := d.vm.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return err
+	}
+	xmldoc, err = updateDiskDriver(xmldoc, d.getDiskTarget(), update)
+	if err != nil {
+		return err
+	}
+	conn, err := d.getConn()
+	if err != nil {
+		return err
+	}
+	vm, err := conn.DomainDefineXML(xmldoc)
+	if err != nil {
+		return fmt.Errorf("Failed to update VM definition: %w", err)
+	}
+	return vm.Free()
+}
+
+// SetDiskCacheMode changes the cache mode of the VM disk, it takes effect the
+// next time the VM starts
+func (d *Driver) SetDiskCacheMode(mode string) error {
+	log.Debugf("Setting disk cache mode of VM %s to %s", d.MachineName, mode)
+	if err := validateCacheMode(mode); err != nil {
+		return err
+	}
+	oldMode := d.CacheMode
+	d.CacheMode = mode
+	if err := d.redefineDiskDriver(func(driver *libvirtxml.DomainDiskDriver) {
+		driver.Cache = d.getDiskCacheMode()
+	}); err != nil {
+		d.CacheMode = oldMode
+		return err
+	}
+	return nil
+}
+
+// SetDiskIOMode changes the IO mode of the VM disk, it takes effect the next
+// time the VM starts
+func (d *Driver) SetDiskIOMode(mode string) error {
+	log.Debugf("Setting disk IO mode of VM %s to %s", d.MachineName, mode)
+	if err := validateIOMode(mode); err != nil {
+		return err
+	}
+	oldMode := d.IOMode
+	d.IOMode = mode
+	if err := d.redefineDiskDriver(func(driver *libvirtxml.DomainDiskDriver) {
+		driver.IO = d.getDiskIOMode()
+	}); err != nil {
+		d.IOMode = oldMode
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package libvirt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"libvirt.org/go/libvirtxml"
+)
+
+func TestUpdateDiskDriver(t *testing.T) {
+	xml, err := domainXML(testDriver(), "q35")
+	assert.NoError(t, err)
+
+	xml, err = updateDiskDriver(xml, "vda", func(driver *libvirtxml.DomainDiskDriver) {
+		driver.Cache = "none"
+		driver.IO = "native"
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<driver name="qemu" type="qcow2" cache="none" io="native"></driver>
+      <source file="machines/domain/domain.test"></source>`)
+
+	_, err = updateDiskDriver(`<domain><devices></devices></domain>`, "vda", func(*libvirtxml.DomainDiskDriver) {})
+	assert.Error(t, err)
+}
+
+func TestValidateCPUTune(t *testing.T) {
+	assert.NoError(t, validateCPUTune(0, 0, 0))
+	assert.NoError(t, validateCPUTune(1024, -1, 100000))
+	assert.NoError(t, validateCPUTune(2, 1000, 1000))
+	assert.Error(t, validateCPUTune(1, 0, 0))
+	assert.Error(t, validateCPUTune(0, 500, 0))
+	assert.Error(t, validateCPUTune(0, -2, 0))
+	assert.Error(t, validateCPUTune(0, 0, 2000000))
+}
+
+func TestValidateMemoryTune(t *testing.T) {
+	assert.NoError(t, validateMemoryTune(4096, 0, 0, 0))
+	assert.NoError(t, validateMemoryTune(4096, 6144, 5120, 8192))
+	assert.NoError(t, validateMemoryTune(4096, 0, 2048, 0))
+	assert.Error(t, validateMemoryTune(4096, 2048, 0, 0))
+	assert.Error(t, validateMemoryTune(4096, 6144, 8192, 0))
+	assert.Error(t, validateMemoryTune(4096, 6144, 0, 5120))
+}